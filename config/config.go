@@ -2,19 +2,33 @@ package config
 
 import (
 	"database/sql"
+	"fmt"
 	_ "github.com/lib/pq"
-	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/spf13/viper"
+	"time"
+	"worker-transcode/pkg/scratch"
+	"worker-transcode/pkg/storage"
 )
 
 type Config struct {
-	MinIOBucket string        `yaml:"minio_bucket"`
-	App         App           `yaml:"app"`
-	DB          *sql.DB       `yaml:"db"`
-	Queue       *RabbitMQ     `yaml:"rabbitmq"`
-	Storage     *minio.Client `yaml:"storage"`
-	Server      Server        `yaml:"server"`
+	MinIOBucket   string              `yaml:"minio_bucket"`
+	App           App                 `yaml:"app"`
+	DB            *sql.DB             `yaml:"db"`
+	Queue         *RabbitMQ           `yaml:"rabbitmq"`
+	Storage       storage.ObjectStore `yaml:"storage"`
+	Stores        *storage.Registry   `yaml:"-"`
+	Server        Server              `yaml:"server"`
+	Slides        Slides              `yaml:"slides"`
+	Transcode     Transcode           `yaml:"transcode"`
+	Upload        Upload              `yaml:"upload"`
+	Retention     SourceRetention     `yaml:"source_retention"`
+	Input         Input               `yaml:"input"`
+	WorkDir       WorkDir             `yaml:"work_dir"`
+	Delivery      Delivery            `yaml:"delivery"`
+	Notifications Notifications       `yaml:"notifications"`
+	Events        Events              `yaml:"events"`
+	Outbox        Outbox              `yaml:"outbox"`
+	Scratch       *scratch.Space      `yaml:"-"`
 }
 
 type App struct {
@@ -28,6 +42,128 @@ type Server struct {
 	Workers  int    `yaml:"workers"`
 }
 
+type Slides struct {
+	SceneThreshold  float64 `yaml:"scene_threshold"`
+	MaxHashDistance int     `yaml:"max_hash_distance"`
+}
+
+type Transcode struct {
+	Deinterlacer string `yaml:"deinterlacer"`
+	HDRVariant   bool   `yaml:"hdr_variant"`
+}
+
+type Upload struct {
+	Concurrency    int           `yaml:"concurrency"`
+	MaxAttempts    int           `yaml:"max_attempts"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+	PartSize       uint64        `yaml:"part_size_mb"`
+	PartThreads    uint          `yaml:"part_threads"`
+	CacheControl   CacheControl  `yaml:"cache_control"`
+}
+
+type CacheControl struct {
+	Segments  string `yaml:"segments"`
+	Manifests string `yaml:"manifests"`
+	Default   string `yaml:"default"`
+}
+
+type SourceRetention struct {
+	Policy         string `yaml:"policy"` // delete, keep or archive
+	ArchiveProfile string `yaml:"archive_profile"`
+	ArchiveBucket  string `yaml:"archive_bucket"`
+	ArchivePrefix  string `yaml:"archive_prefix"`
+	StorageClass   string `yaml:"storage_class"`
+}
+
+type Input struct {
+	// StreamThreshold is the source size in bytes from which ffmpeg reads a
+	// presigned URL instead of a downloaded copy. Zero always downloads.
+	StreamThreshold int64         `yaml:"stream_threshold_mb"`
+	PresignExpiry   time.Duration `yaml:"presign_expiry"`
+	// AllowedHosts are the only hosts ffmpeg may stream from, together with
+	// their subdomains. They default to the hosts of the storage profiles.
+	AllowedHosts []string `yaml:"allowed_hosts"`
+}
+
+type WorkDir struct {
+	Root    string `yaml:"root"`
+	MinFree uint64 `yaml:"min_free_mb"`
+	// OutputFactor estimates the scratch space a job needs for its output as
+	// a multiple of the source size.
+	OutputFactor  float64       `yaml:"output_factor"`
+	PauseInterval time.Duration `yaml:"pause_interval"`
+	// StaleAfter is how long a job still marked as processing counts as
+	// running without being touched. Older jobs are taken over by the next
+	// delivery of their message and their directories are swept at startup.
+	StaleAfter time.Duration `yaml:"stale_after"`
+}
+
+type Delivery struct {
+	// Mode is how result URLs are produced: presign (storage presigned URLs),
+	// cdn (signed CDN URLs) or none (bare object keys).
+	Mode   string        `yaml:"mode"`
+	Expiry time.Duration `yaml:"expiry"`
+	// SignPlaylists publishes copies of the playlists whose URIs are absolute
+	// signed URLs, for playback straight from a private bucket.
+	SignPlaylists bool `yaml:"sign_playlists"`
+	CDN           CDN  `yaml:"cdn"`
+}
+
+// CDN holds the settings for Cloud CDN style signed URLs.
+type CDN struct {
+	BaseURL string `yaml:"base_url"`
+	KeyName string `yaml:"key_name"`
+	Key     string `yaml:"key"` // base64url encoded signing key
+}
+
+// Events configures the job lifecycle events published for the LMS.
+type Events struct {
+	Enabled      bool   `yaml:"enabled"`
+	Exchange     string `yaml:"exchange"`
+	ExchangeKind string `yaml:"exchange_kind"`
+	// ConfirmTimeout bounds the wait for the broker to confirm an event.
+	ConfirmTimeout time.Duration `yaml:"confirm_timeout"`
+}
+
+// Outbox configures the relay that publishes recorded events.
+type Outbox struct {
+	PollInterval time.Duration `yaml:"poll_interval"`
+	BatchSize    int           `yaml:"batch_size"`
+	// KeepSent is how long published events stay in the table, zero keeps
+	// them forever.
+	KeepSent time.Duration `yaml:"keep_sent"`
+}
+
+// Notifications configures jobs triggered by bucket notifications that MinIO
+// publishes to an AMQP exchange. The queue itself is declared like any other
+// under consumers, with the bucket_notification handler.
+type Notifications struct {
+	// DedupWindow is how long a later job of the same lesson for the same
+	// object version links to the output of a completed job instead of
+	// encoding it again.
+	DedupWindow time.Duration `mapstructure:"dedup_window"`
+	// ClaimWait is how long a job waits for another job that claimed the
+	// same object version before it fails.
+	ClaimWait time.Duration      `mapstructure:"claim_wait"`
+	Rules     []NotificationRule `mapstructure:"rules"`
+}
+
+// NotificationRule selects the uploads that start a transcode job.
+// LessonPattern must capture the lesson id in a group named lesson_id.
+type NotificationRule struct {
+	Profile            string   `mapstructure:"profile"`
+	Bucket             string   `mapstructure:"bucket"`
+	Prefix             string   `mapstructure:"prefix"`
+	Extensions         []string `mapstructure:"extensions"`
+	LessonPattern      string   `mapstructure:"lesson_pattern"`
+	ExtractSlides      bool     `mapstructure:"extract_slides"`
+	DestinationProfile string   `mapstructure:"destination_profile"`
+	DestinationBucket  string   `mapstructure:"destination_bucket"`
+}
+
+const DefaultStorageProfile = "default"
+
 type RabbitMQ struct {
 	Host         string `json:"host"`
 	Port         int    `json:"port"`
@@ -35,12 +171,243 @@ type RabbitMQ struct {
 	Pass         string `json:"pass"`
 	ExchangeName string `json:"exchange_name"`
 	Kind         string `json:"kind"`
+	Consumers    []ConsumerQueue
+}
+
+// ConsumerQueue declares a queue the worker consumes and names the handler
+// its messages are dispatched to.
+type ConsumerQueue struct {
+	Handler string `mapstructure:"handler"`
+	// ExchangeKind defaults to rabbitmq_kind.
+	ExchangeKind string     `mapstructure:"exchange_kind"`
+	Exchange     string     `mapstructure:"exchange"`
+	Queue        string     `mapstructure:"queue"`
+	RoutingKey   string     `mapstructure:"routing_key"`
+	DeadLetter   DeadLetter `mapstructure:"dead_letter"`
+	// Retry defaults to the top-level retry settings.
+	Retry Retry `mapstructure:"retry"`
+	// Workers defaults to server.workers and Prefetch to Workers.
+	Workers  int `mapstructure:"workers"`
+	Prefetch int `mapstructure:"prefetch"`
+	// Priority defaults to the top-level queue_priority settings.
+	Priority QueuePriority `mapstructure:"priority"`
+}
+
+// QueuePriority configures a priority queue and the workers kept free for
+// high priority messages. Publishers route those with HighRoutingKey to their
+// own queue, <queue>.high, which ReservedWorkers of the workers consume alone,
+// so they find a free worker even while the queue is saturated. Idle workers
+// take from it as well. A consumer inherits every setting it does not set
+// itself, zero included, except HighRoutingKey.
+type QueuePriority struct {
+	// MaxPriority is declared as x-max-priority, zero declares a plain
+	// queue. RabbitMQ refuses to change it on an existing queue, so it is
+	// off by default.
+	MaxPriority int `mapstructure:"max_priority"`
+	// HighRoutingKey defaults to the routing key with a .high suffix.
+	HighRoutingKey  string `mapstructure:"high_routing_key"`
+	ReservedWorkers int    `mapstructure:"reserved_workers"`
+}
+
+// Retry configures the broker-side retries of failed messages. A failed
+// message is republished to a retry queue that holds it for the delay of its
+// attempt, the last delay is used for all later attempts. It goes to the dead
+// letter queue once MaxAttempts deliveries failed. Messages that failed for
+// lack of a worker resource are held for ResourceDelay without counting an
+// attempt, up to MaxResourceRetries times.
+type Retry struct {
+	MaxAttempts        int             `mapstructure:"max_attempts"`
+	Delays             []time.Duration `mapstructure:"delays"`
+	ResourceDelay      time.Duration   `mapstructure:"resource_delay"`
+	MaxResourceRetries int             `mapstructure:"max_resource_retries"`
+}
+
+// DeadLetter is where rejected messages of a queue end up. The names default
+// to <queue>_dlx, <queue>_dlq and dlq.<queue>, so every queue has its own.
+type DeadLetter struct {
+	Exchange   string `mapstructure:"exchange"`
+	Queue      string `mapstructure:"queue"`
+	RoutingKey string `mapstructure:"routing_key"`
+}
+
+// defaultConsumers are the queues consumed when the config does not list any.
+var defaultConsumers = []map[string]interface{}{
+	{
+		"handler":     "transcode",
+		"exchange":    "transcoding_exchange",
+		"queue":       "transcoding_queue",
+		"routing_key": "video.transcoding.request",
+		"dead_letter": map[string]interface{}{
+			"exchange":    "transcoding_exchange_dlx",
+			"queue":       "transcoding_queue_dlq",
+			"routing_key": "dlq.video.transcoding.request",
+		},
+	},
+	{
+		"handler":     "recording_merge",
+		"exchange":    "recording_exchange",
+		"queue":       "recording_merge_queue",
+		"routing_key": "recording.merge.request",
+		"dead_letter": map[string]interface{}{
+			"exchange":    "recording_merge_queue_dlx",
+			"queue":       "recording_merge_queue_dlq",
+			"routing_key": "dlq.recording.merge.request",
+		},
+	},
+}
+
+func loadConsumers(kind string, workers int) ([]ConsumerQueue, error) {
+	var consumers []ConsumerQueue
+	if err := viper.UnmarshalKey("consumers", &consumers); err != nil {
+		return nil, err
+	}
+	// The raw entries tell a priority setting of zero from a missing one.
+	var raw []map[string]interface{}
+	if err := viper.UnmarshalKey("consumers", &raw); err != nil {
+		return nil, err
+	}
+	var retry Retry
+	if err := viper.UnmarshalKey("retry", &retry); err != nil {
+		return nil, err
+	}
+	var priority QueuePriority
+	if err := viper.UnmarshalKey("queue_priority", &priority); err != nil {
+		return nil, err
+	}
+
+	for i := range consumers {
+		c := &consumers[i]
+		if c.Handler == "" || c.Exchange == "" || c.Queue == "" {
+			return nil, fmt.Errorf("consumer %d: handler, exchange and queue are required", i)
+		}
+		if c.ExchangeKind == "" {
+			c.ExchangeKind = kind
+		}
+		if c.Workers < 1 {
+			c.Workers = max(workers, 1)
+		}
+		if c.Prefetch < 1 {
+			c.Prefetch = c.Workers
+		}
+		if c.DeadLetter.Exchange == "" {
+			c.DeadLetter.Exchange = c.Queue + "_dlx"
+		}
+		if c.DeadLetter.Queue == "" {
+			c.DeadLetter.Queue = c.Queue + "_dlq"
+		}
+		if c.DeadLetter.RoutingKey == "" {
+			c.DeadLetter.RoutingKey = "dlq." + c.Queue
+		}
+		if c.Retry.MaxAttempts < 1 {
+			c.Retry.MaxAttempts = max(retry.MaxAttempts, 1)
+		}
+		if len(c.Retry.Delays) == 0 {
+			c.Retry.Delays = retry.Delays
+		}
+		if c.Retry.ResourceDelay <= 0 {
+			c.Retry.ResourceDelay = retry.ResourceDelay
+		}
+		if c.Retry.MaxResourceRetries < 1 {
+			c.Retry.MaxResourceRetries = max(retry.MaxResourceRetries, 1)
+		}
+		if c.Retry.ResourceDelay <= 0 {
+			return nil, fmt.Errorf("consumer %s: retry resource_delay must be positive", c.Queue)
+		}
+		if c.Retry.MaxAttempts > 1 && len(c.Retry.Delays) == 0 {
+			return nil, fmt.Errorf("consumer %s: retries need at least one delay", c.Queue)
+		}
+		for _, delay := range c.Retry.Delays {
+			if delay <= 0 {
+				return nil, fmt.Errorf("consumer %s: retry delays must be positive", c.Queue)
+			}
+		}
+		if !isSet(raw[i], "priority", "max_priority") {
+			c.Priority.MaxPriority = priority.MaxPriority
+		}
+		if !isSet(raw[i], "priority", "reserved_workers") {
+			c.Priority.ReservedWorkers = priority.ReservedWorkers
+		}
+		if c.Priority.MaxPriority < 0 || c.Priority.MaxPriority > 255 {
+			return nil, fmt.Errorf("consumer %s: max_priority must be between 0 and 255", c.Queue)
+		}
+		if c.Priority.ReservedWorkers >= c.Workers {
+			return nil, fmt.Errorf("consumer %s: reserved_workers must leave at least one of %d workers", c.Queue, c.Workers)
+		}
+		if c.Priority.ReservedWorkers > 0 {
+			if c.ExchangeKind != "direct" && c.ExchangeKind != "topic" {
+				return nil, fmt.Errorf("consumer %s: reserved_workers need a direct or topic exchange to route high priority messages", c.Queue)
+			}
+			if c.Priority.HighRoutingKey == "" {
+				c.Priority.HighRoutingKey = c.RoutingKey + ".high"
+			}
+			if c.Priority.HighRoutingKey == c.RoutingKey {
+				return nil, fmt.Errorf("consumer %s: high_routing_key must differ from routing_key", c.Queue)
+			}
+		}
+	}
+
+	return consumers, nil
+}
+
+// isSet reports whether the nested key path is present in entry.
+func isSet(entry map[string]interface{}, path ...string) bool {
+	var value interface{} = entry
+	for _, key := range path {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if value, ok = m[key]; !ok {
+			return false
+		}
+	}
+
+	return true
 }
 
 func Load(path string) (*Config, error) {
 	viper.AddConfigPath(path)
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
+	viper.SetDefault("slides.scene_threshold", 0.3)
+	viper.SetDefault("slides.max_hash_distance", 6)
+	viper.SetDefault("transcode.deinterlacer", "bwdif")
+	viper.SetDefault("upload.concurrency", 8)
+	viper.SetDefault("upload.max_attempts", 4)
+	viper.SetDefault("upload.initial_backoff", "500ms")
+	viper.SetDefault("upload.max_backoff", "10s")
+	viper.SetDefault("upload.part_size_mb", 16)
+	viper.SetDefault("upload.part_threads", 4)
+	viper.SetDefault("upload.cache_control.segments", "public, max-age=31536000, immutable")
+	viper.SetDefault("upload.cache_control.manifests", "public, max-age=10")
+	viper.SetDefault("source_retention.policy", "delete")
+	viper.SetDefault("source_retention.archive_prefix", "archive/sources")
+	viper.SetDefault("input.stream_threshold_mb", 0)
+	viper.SetDefault("input.presign_expiry", "12h")
+	viper.SetDefault("work_dir.root", "temp")
+	viper.SetDefault("work_dir.min_free_mb", 2048)
+	viper.SetDefault("work_dir.output_factor", 1.0)
+	viper.SetDefault("work_dir.pause_interval", "30s")
+	viper.SetDefault("work_dir.stale_after", "24h")
+	viper.SetDefault("delivery.mode", "presign")
+	viper.SetDefault("delivery.expiry", "24h")
+	viper.SetDefault("consumers", defaultConsumers)
+	viper.SetDefault("retry.max_attempts", 5)
+	viper.SetDefault("retry.delays", []string{"10s", "1m", "5m", "15m"})
+	viper.SetDefault("retry.resource_delay", "1m")
+	viper.SetDefault("retry.max_resource_retries", 60)
+	viper.SetDefault("queue_priority.max_priority", 0)
+	viper.SetDefault("events.enabled", true)
+	viper.SetDefault("events.exchange", "job_events")
+	viper.SetDefault("events.exchange_kind", "topic")
+	viper.SetDefault("events.confirm_timeout", "5s")
+	viper.SetDefault("outbox.poll_interval", "1s")
+	viper.SetDefault("outbox.batch_size", 100)
+	viper.SetDefault("outbox.keep_sent", "168h")
+	viper.SetDefault("notifications.dedup_window", "1h")
+	viper.SetDefault("notifications.claim_wait", "12h")
+	viper.SetDefault("storage.backend", "minio")
+	viper.SetDefault("storage.local.root", "storage")
 	err := viper.ReadInConfig()
 	if err != nil {
 		return nil, err
@@ -58,15 +425,77 @@ func Load(path string) (*Config, error) {
 		Pass: viper.GetString("rabbitmq_pass"),
 		Kind: viper.GetString("rabbitmq_kind"),
 	}
+	rabbitmq.Consumers, err = loadConsumers(rabbitmq.Kind, viper.GetInt("server.workers"))
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := map[string]StorageProfile{}
+	if err := viper.UnmarshalKey("storage.profiles", &profiles); err != nil {
+		return nil, err
+	}
+	profiles[DefaultStorageProfile] = StorageProfile{
+		Backend:            viper.GetString("storage.backend"),
+		Endpoint:           viper.GetString("minio.url"),
+		AccessID:           viper.GetString("minio.access_id"),
+		SecretAccessKey:    viper.GetString("minio.secret_access_key"),
+		Secure:             viper.GetBool("minio.secure"),
+		CABundle:           viper.GetString("minio.ca_bundle"),
+		InsecureSkipVerify: viper.GetBool("minio.insecure_skip_verify"),
+		Region:             viper.GetString("minio.region"),
+		Addressing:         viper.GetString("minio.addressing"),
+		Credentials:        viper.GetStringSlice("minio.credentials"),
+		CredentialsFile:    viper.GetString("minio.credentials_file"),
+		CredentialsProfile: viper.GetString("minio.credentials_profile"),
+		Encryption: Encryption{
+			Type:            viper.GetString("minio.encryption.type"),
+			KMSKeyID:        viper.GetString("minio.encryption.kms_key_id"),
+			CustomerKey:     viper.GetString("minio.encryption.customer_key"),
+			CustomerKeyFile: viper.GetString("minio.encryption.customer_key_file"),
+		},
+		Bucket:       viper.GetString("minio.bucket"),
+		LocalRoot:    viper.GetString("storage.local.root"),
+		LocalBaseURL: viper.GetString("storage.local.base_url"),
+	}
 
-	minioClient, err := minio.New(viper.GetString("minio.url"), &minio.Options{
-		Creds:  credentials.NewStaticV4(viper.GetString("minio.access_id"), viper.GetString("minio.secret_access_key"), ""),
-		Secure: false,
-	})
+	stores := storage.NewRegistry(DefaultStorageProfile)
+	for name, profile := range profiles {
+		store, err := newObjectStore(profile)
+		if err != nil {
+			return nil, fmt.Errorf("storage profile %q: %w", name, err)
+		}
+		stores.Register(name, store, profile.Bucket)
+	}
+	defaultStore, err := stores.Resolve(DefaultStorageProfile, "")
 	if err != nil {
 		return nil, err
 	}
 
+	var notifications Notifications
+	if err := viper.UnmarshalKey("notifications", &notifications); err != nil {
+		return nil, err
+	}
+
+	workDir := WorkDir{
+		Root:          viper.GetString("work_dir.root"),
+		MinFree:       viper.GetUint64("work_dir.min_free_mb") * 1024 * 1024,
+		OutputFactor:  viper.GetFloat64("work_dir.output_factor"),
+		PauseInterval: viper.GetDuration("work_dir.pause_interval"),
+		StaleAfter:    viper.GetDuration("work_dir.stale_after"),
+	}
+
+	events := Events{
+		Enabled:        viper.GetBool("events.enabled"),
+		Exchange:       viper.GetString("events.exchange"),
+		ExchangeKind:   viper.GetString("events.exchange_kind"),
+		ConfirmTimeout: viper.GetDuration("events.confirm_timeout"),
+	}
+
+	allowedHosts := viper.GetStringSlice("input.allowed_hosts")
+	if len(allowedHosts) == 0 {
+		allowedHosts = storageHosts(profiles)
+	}
+
 	return &Config{
 		MinIOBucket: viper.GetString("minio.bucket"),
 		App: App{
@@ -78,8 +507,61 @@ func Load(path string) (*Config, error) {
 			HttpPort: viper.GetString("server.port"),
 			Workers:  viper.GetInt("server.workers"),
 		},
-		DB:      db,
-		Queue:   rabbitmq,
-		Storage: minioClient,
+		Slides: Slides{
+			SceneThreshold:  viper.GetFloat64("slides.scene_threshold"),
+			MaxHashDistance: viper.GetInt("slides.max_hash_distance"),
+		},
+		Transcode: Transcode{
+			Deinterlacer: viper.GetString("transcode.deinterlacer"),
+			HDRVariant:   viper.GetBool("transcode.hdr_variant"),
+		},
+		Upload: Upload{
+			Concurrency:    viper.GetInt("upload.concurrency"),
+			MaxAttempts:    viper.GetInt("upload.max_attempts"),
+			InitialBackoff: viper.GetDuration("upload.initial_backoff"),
+			MaxBackoff:     viper.GetDuration("upload.max_backoff"),
+			PartSize:       viper.GetUint64("upload.part_size_mb") * 1024 * 1024,
+			PartThreads:    viper.GetUint("upload.part_threads"),
+			CacheControl: CacheControl{
+				Segments:  viper.GetString("upload.cache_control.segments"),
+				Manifests: viper.GetString("upload.cache_control.manifests"),
+				Default:   viper.GetString("upload.cache_control.default"),
+			},
+		},
+		Retention: SourceRetention{
+			Policy:         viper.GetString("source_retention.policy"),
+			ArchiveProfile: viper.GetString("source_retention.archive_profile"),
+			ArchiveBucket:  viper.GetString("source_retention.archive_bucket"),
+			ArchivePrefix:  viper.GetString("source_retention.archive_prefix"),
+			StorageClass:   viper.GetString("source_retention.storage_class"),
+		},
+		Input: Input{
+			StreamThreshold: viper.GetInt64("input.stream_threshold_mb") * 1024 * 1024,
+			PresignExpiry:   viper.GetDuration("input.presign_expiry"),
+			AllowedHosts:    allowedHosts,
+		},
+		Delivery: Delivery{
+			Mode:          viper.GetString("delivery.mode"),
+			Expiry:        viper.GetDuration("delivery.expiry"),
+			SignPlaylists: viper.GetBool("delivery.sign_playlists"),
+			CDN: CDN{
+				BaseURL: viper.GetString("delivery.cdn.base_url"),
+				KeyName: viper.GetString("delivery.cdn.key_name"),
+				Key:     viper.GetString("delivery.cdn.key"),
+			},
+		},
+		Notifications: notifications,
+		Events:        events,
+		WorkDir:       workDir,
+		Scratch:       scratch.New(workDir.Root, workDir.MinFree),
+		DB:            db,
+		Queue:         rabbitmq,
+		Storage:       defaultStore.Store,
+		Stores:        stores,
+		Outbox: Outbox{
+			PollInterval: viper.GetDuration("outbox.poll_interval"),
+			BatchSize:    max(viper.GetInt("outbox.batch_size"), 1),
+			KeepSent:     viper.GetDuration("outbox.keep_sent"),
+		},
 	}, nil
 }
@@ -0,0 +1,189 @@
+package config
+
+import (
+	"github.com/spf13/viper"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readConfig(t *testing.T, content string) {
+	t.Helper()
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.SetConfigType("yaml")
+	viper.SetDefault("consumers", defaultConsumers)
+	if err := viper.ReadConfig(strings.NewReader(content)); err != nil {
+		t.Fatalf("ReadConfig() = %v", err)
+	}
+}
+
+const retryConfig = `
+retry:
+  max_attempts: 5
+  delays: ["10s", "1m"]
+  resource_delay: "1m"
+  max_resource_retries: 30
+queue_priority:
+  max_priority: 10
+`
+
+func TestLoadConsumersDefaults(t *testing.T) {
+	readConfig(t, retryConfig)
+
+	consumers, err := loadConsumers("topic", 3)
+	if err != nil {
+		t.Fatalf("loadConsumers() = %v", err)
+	}
+	if len(consumers) != 2 || consumers[0].Handler != "transcode" || consumers[1].Handler != "recording_merge" {
+		t.Fatalf("loadConsumers() = %+v, want the default consumers", consumers)
+	}
+
+	c := consumers[0]
+	if c.ExchangeKind != "topic" || c.Workers != 3 || c.Prefetch != 3 {
+		t.Errorf("kind, workers, prefetch = %s, %d, %d", c.ExchangeKind, c.Workers, c.Prefetch)
+	}
+	if c.DeadLetter.Queue != "transcoding_queue_dlq" {
+		t.Errorf("dead letter queue = %s", c.DeadLetter.Queue)
+	}
+	if consumers[1].DeadLetter.Exchange == c.DeadLetter.Exchange {
+		t.Errorf("consumers share the dead letter exchange %s", c.DeadLetter.Exchange)
+	}
+	if c.Retry.MaxAttempts != 5 || !slices.Equal(c.Retry.Delays, []time.Duration{10 * time.Second, time.Minute}) ||
+		c.Retry.ResourceDelay != time.Minute || c.Retry.MaxResourceRetries != 30 {
+		t.Errorf("retry = %+v", c.Retry)
+	}
+	if c.Priority != (QueuePriority{MaxPriority: 10}) {
+		t.Errorf("priority = %+v", c.Priority)
+	}
+}
+
+func TestLoadConsumersOverrides(t *testing.T) {
+	readConfig(t, retryConfig+`
+consumers:
+  - handler: "transcode"
+    exchange: "transcoding_exchange"
+    queue: "transcoding_queue"
+    routing_key: "video.transcoding.request"
+    workers: 4
+    retry:
+      max_attempts: 2
+    priority:
+      reserved_workers: 1
+  - handler: "recording_merge"
+    exchange: "recording_exchange"
+    queue: "recording_merge_queue"
+    priority:
+      max_priority: 0
+`)
+
+	consumers, err := loadConsumers("topic", 2)
+	if err != nil {
+		t.Fatalf("loadConsumers() = %v", err)
+	}
+
+	transcode := consumers[0]
+	if transcode.Workers != 4 || transcode.Prefetch != 4 || transcode.Retry.MaxAttempts != 2 {
+		t.Errorf("workers, prefetch, attempts = %d, %d, %d", transcode.Workers, transcode.Prefetch, transcode.Retry.MaxAttempts)
+	}
+	if transcode.DeadLetter != (DeadLetter{Exchange: "transcoding_queue_dlx", Queue: "transcoding_queue_dlq", RoutingKey: "dlq.transcoding_queue"}) {
+		t.Errorf("dead letter = %+v", transcode.DeadLetter)
+	}
+	if transcode.Priority != (QueuePriority{MaxPriority: 10, HighRoutingKey: "video.transcoding.request.high", ReservedWorkers: 1}) {
+		t.Errorf("transcode priority = %+v", transcode.Priority)
+	}
+	if consumers[1].Priority.MaxPriority != 0 {
+		t.Errorf("recording_merge max_priority = %d, want the override to 0", consumers[1].Priority.MaxPriority)
+	}
+}
+
+func TestLoadConsumersInvalid(t *testing.T) {
+	tests := []struct {
+		name      string
+		consumers string
+	}{
+		{"missing queue", `
+  - handler: "transcode"
+    exchange: "transcoding_exchange"`},
+		{"negative delay", `
+  - handler: "transcode"
+    exchange: "transcoding_exchange"
+    queue: "transcoding_queue"
+    retry:
+      delays: ["-1s"]`},
+		{"all workers reserved", `
+  - handler: "transcode"
+    exchange: "transcoding_exchange"
+    queue: "transcoding_queue"
+    workers: 2
+    priority:
+      reserved_workers: 2`},
+		{"reserved on a fanout exchange", `
+  - handler: "bucket_notification"
+    exchange: "minio_events"
+    exchange_kind: "fanout"
+    queue: "minio_events_queue"
+    workers: 2
+    priority:
+      reserved_workers: 1`},
+		{"high routing key is the routing key", `
+  - handler: "transcode"
+    exchange: "transcoding_exchange"
+    queue: "transcoding_queue"
+    routing_key: "video.transcoding.request"
+    workers: 2
+    priority:
+      high_routing_key: "video.transcoding.request"
+      reserved_workers: 1`},
+		{"max priority out of range", `
+  - handler: "transcode"
+    exchange: "transcoding_exchange"
+    queue: "transcoding_queue"
+    priority:
+      max_priority: 256`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			readConfig(t, retryConfig+"\nconsumers:"+tt.consumers+"\n")
+			if _, err := loadConsumers("topic", 2); err == nil {
+				t.Error("loadConsumers() succeeded")
+			}
+		})
+	}
+}
+
+func TestStorageHosts(t *testing.T) {
+	hosts := storageHosts(map[string]StorageProfile{
+		"default": {Backend: "minio", Endpoint: "minio:9000"},
+		"aws":     {Endpoint: "s3.amazonaws.com"},
+		"files":   {Backend: "local", LocalBaseURL: "https://files.example.com/media"},
+		"scratch": {Backend: "memory"},
+	})
+
+	want := []string{"amazonaws.com", "files.example.com", "minio:9000"}
+	if !slices.Equal(hosts, want) {
+		t.Errorf("storageHosts() = %v, want %v", hosts, want)
+	}
+}
+
+func TestNewCredentials(t *testing.T) {
+	tests := []struct {
+		name    string
+		chain   []string
+		wantErr bool
+	}{
+		{"default", nil, false},
+		{"known", []string{"static", "ENV_AWS", "iam"}, false},
+		{"unknown", []string{"env_aws", "vault"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newCredentials(StorageProfile{Credentials: tt.chain}); (err != nil) != tt.wantErr {
+				t.Errorf("newCredentials() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
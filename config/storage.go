@@ -0,0 +1,231 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/minio/minio-go/v7/pkg/s3utils"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"worker-transcode/pkg/storage"
+)
+
+// StorageProfile describes one storage endpoint. The default profile is
+// built from the top-level storage and minio settings, further profiles live
+// under storage.profiles.
+type StorageProfile struct {
+	Backend         string `mapstructure:"backend"`
+	Endpoint        string `mapstructure:"endpoint"`
+	AccessID        string `mapstructure:"access_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+	Bucket          string `mapstructure:"bucket"`
+	LocalRoot       string `mapstructure:"local_root"`
+	LocalBaseURL    string `mapstructure:"local_base_url"`
+
+	Secure             bool   `mapstructure:"secure"`
+	CABundle           string `mapstructure:"ca_bundle"` // PEM file trusted in addition to the system pool
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+	Region             string `mapstructure:"region"`
+	Addressing         string `mapstructure:"addressing"` // auto, path or virtual
+
+	// Credentials is the chain of providers tried in order: static (the
+	// inline keys), env_aws, env_minio, file_aws, file_minio and iam.
+	Credentials        []string   `mapstructure:"credentials"`
+	CredentialsFile    string     `mapstructure:"credentials_file"`
+	CredentialsProfile string     `mapstructure:"credentials_profile"`
+	Encryption         Encryption `mapstructure:"encryption"`
+}
+
+type Encryption struct {
+	Type            string `mapstructure:"type"` // sse-s3, sse-kms or sse-c
+	KMSKeyID        string `mapstructure:"kms_key_id"`
+	CustomerKey     string `mapstructure:"customer_key"` // base64, 32 bytes
+	CustomerKeyFile string `mapstructure:"customer_key_file"`
+}
+
+func newObjectStore(profile StorageProfile) (storage.ObjectStore, error) {
+	switch profile.Backend {
+	case "", "minio":
+		transport, err := newTransport(profile)
+		if err != nil {
+			return nil, err
+		}
+		lookup, err := bucketLookup(profile.Addressing)
+		if err != nil {
+			return nil, err
+		}
+		sse, err := newServerSideEncryption(profile.Encryption)
+		if err != nil {
+			return nil, err
+		}
+		creds, err := newCredentials(profile)
+		if err != nil {
+			return nil, err
+		}
+
+		minioClient, err := minio.New(profile.Endpoint, &minio.Options{
+			Creds:        creds,
+			Secure:       profile.Secure,
+			Transport:    transport,
+			Region:       profile.Region,
+			BucketLookup: lookup,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewMinIO(minioClient, sse), nil
+	case "local":
+		root := profile.LocalRoot
+		if root == "" {
+			root = "storage"
+		}
+		return storage.NewLocal(root, profile.LocalBaseURL), nil
+	case "memory":
+		return storage.NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", profile.Backend)
+	}
+}
+
+func newTransport(profile StorageProfile) (http.RoundTripper, error) {
+	transport, err := minio.DefaultTransport(profile.Secure)
+	if err != nil {
+		return nil, err
+	}
+	if !profile.Secure || (profile.CABundle == "" && !profile.InsecureSkipVerify) {
+		return transport, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: profile.InsecureSkipVerify,
+	}
+	if profile.CABundle != "" {
+		pem, err := os.ReadFile(profile.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", profile.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	return transport, nil
+}
+
+func bucketLookup(addressing string) (minio.BucketLookupType, error) {
+	switch addressing {
+	case "", "auto":
+		return minio.BucketLookupAuto, nil
+	case "path":
+		return minio.BucketLookupPath, nil
+	case "virtual":
+		return minio.BucketLookupDNS, nil
+	default:
+		return minio.BucketLookupAuto, fmt.Errorf("unknown addressing style %q", addressing)
+	}
+}
+
+// newCredentials builds the credential chain. Without an explicit chain the
+// inline keys are used when set, otherwise the environment, credential files
+// and the instance role are tried in that order.
+func newCredentials(profile StorageProfile) (*credentials.Credentials, error) {
+	chain := profile.Credentials
+	if len(chain) == 0 {
+		if profile.AccessID != "" {
+			chain = []string{"static"}
+		} else {
+			chain = []string{"env_aws", "env_minio", "file_aws", "file_minio", "iam"}
+		}
+	}
+
+	providers := make([]credentials.Provider, 0, len(chain))
+	for _, name := range chain {
+		switch strings.ToLower(name) {
+		case "static":
+			providers = append(providers, &credentials.Static{Value: credentials.Value{
+				AccessKeyID:     profile.AccessID,
+				SecretAccessKey: profile.SecretAccessKey,
+				SignerType:      credentials.SignatureV4,
+			}})
+		case "env_aws":
+			providers = append(providers, &credentials.EnvAWS{})
+		case "env_minio":
+			providers = append(providers, &credentials.EnvMinio{})
+		case "file_aws":
+			providers = append(providers, &credentials.FileAWSCredentials{Filename: profile.CredentialsFile, Profile: profile.CredentialsProfile})
+		case "file_minio":
+			providers = append(providers, &credentials.FileMinioClient{Filename: profile.CredentialsFile, Alias: profile.CredentialsProfile})
+		case "iam":
+			providers = append(providers, &credentials.IAM{Client: &http.Client{Transport: http.DefaultTransport}})
+		default:
+			return nil, fmt.Errorf("unknown credentials provider %q", name)
+		}
+	}
+
+	return credentials.NewChainCredentials(providers), nil
+}
+
+func newServerSideEncryption(cfg Encryption) (encrypt.ServerSide, error) {
+	switch strings.ToLower(cfg.Type) {
+	case "":
+		return nil, nil
+	case "sse-s3":
+		return encrypt.NewSSE(), nil
+	case "sse-kms":
+		return encrypt.NewSSEKMS(cfg.KMSKeyID, nil)
+	case "sse-c":
+		encoded := cfg.CustomerKey
+		if cfg.CustomerKeyFile != "" {
+			content, err := os.ReadFile(cfg.CustomerKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read SSE-C key: %w", err)
+			}
+			encoded = strings.TrimSpace(string(content))
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSE-C key: %w", err)
+		}
+		return encrypt.NewSSEC(key)
+	default:
+		return nil, fmt.Errorf("unknown encryption type %q", cfg.Type)
+	}
+}
+
+// storageHosts returns the hosts presigned URLs of the configured profiles
+// point at. The client replaces an AWS endpoint with the regional one of the
+// bucket, so those allow the whole amazonaws domain.
+func storageHosts(profiles map[string]StorageProfile) []string {
+	var hosts []string
+	for _, profile := range profiles {
+		switch profile.Backend {
+		case "", "minio":
+			host := profile.Endpoint
+			if i := strings.Index(host, "amazonaws."); i >= 0 && s3utils.IsAmazonEndpoint(url.URL{Host: host}) {
+				host = host[i:]
+			}
+			hosts = append(hosts, host)
+		case "local":
+			if u, err := url.Parse(profile.LocalBaseURL); err == nil && u.Host != "" {
+				hosts = append(hosts, u.Host)
+			}
+		}
+	}
+	sort.Strings(hosts)
+
+	return hosts
+}
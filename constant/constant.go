@@ -16,6 +16,17 @@ const (
 	JobTypeRecordingMerge JobType = "recording_merge"
 )
 
+// JobEvent is the type of a lifecycle event, it doubles as the routing key
+// the event is published with.
+type JobEvent string
+
+const (
+	JobEventStarted   JobEvent = "job.started"
+	JobEventProgress  JobEvent = "job.progress"
+	JobEventCompleted JobEvent = "job.completed"
+	JobEventFailed    JobEvent = "job.failed"
+)
+
 type Environment string
 
 const (
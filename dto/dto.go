@@ -1,14 +1,98 @@
 package dto
 
-import "github.com/google/uuid"
+import (
+	"github.com/google/uuid"
+	"time"
+	"worker-transcode/constant"
+)
+
+// StorageTarget selects a storage profile and bucket. Empty fields fall back
+// to the default profile and the profile's bucket.
+type StorageTarget struct {
+	Profile string `json:"profile,omitempty"`
+	Bucket  string `json:"bucket,omitempty"`
+}
 
 type JobMessage struct {
-	JobId      uuid.UUID `json:"jobId"`
-	ObjectPath string    `json:"objectPath"`
-	FileName   string    `json:"fileName"`
+	JobId         uuid.UUID     `json:"jobId"`
+	ObjectPath    string        `json:"objectPath"`
+	FileName      string        `json:"fileName"`
+	ExtractSlides bool          `json:"extractSlides"`
+	Source        StorageTarget `json:"source"`
+	Destination   StorageTarget `json:"destination"`
+	// Priority is used when the publisher did not set the AMQP priority
+	// property. Only the property orders the queue, so publishers should set
+	// both.
+	Priority uint8 `json:"priority,omitempty"`
+	// Redelivered is set by the handler when the broker delivers the message
+	// again because the worker holding it went away.
+	Redelivered bool `json:"-"`
 }
 
 type RecordingMergeMessage struct {
-	JobId         uuid.UUID `json:"jobId"`
-	LiveSessionId uuid.UUID `json:"liveSessionId"`
-}
\ No newline at end of file
+	JobId         uuid.UUID     `json:"jobId"`
+	LiveSessionId uuid.UUID     `json:"liveSessionId"`
+	ExtractSlides bool          `json:"extractSlides"`
+	Source        StorageTarget `json:"source"`
+	Destination   StorageTarget `json:"destination"`
+	// Priority, see JobMessage.
+	Priority uint8 `json:"priority,omitempty"`
+}
+
+// BucketEvent is the S3 event notification MinIO publishes to AMQP.
+type BucketEvent struct {
+	EventName string              `json:"EventName"`
+	Key       string              `json:"Key"`
+	Records   []BucketEventRecord `json:"Records"`
+	// Redelivered, see JobMessage.
+	Redelivered bool `json:"-"`
+}
+
+type BucketEventRecord struct {
+	EventName string `json:"eventName"`
+	S3        struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			Key  string `json:"key"` // URL encoded
+			Size int64  `json:"size"`
+			ETag string `json:"eTag"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+// JobEvent is published to the events exchange at every transition of a job.
+type JobEvent struct {
+	Event      constant.JobEvent `json:"event"`
+	JobId      uuid.UUID         `json:"jobId"`
+	EntityId   uuid.UUID         `json:"entityId"`
+	EntityType string            `json:"entityType"`
+	JobType    constant.JobType  `json:"jobType"`
+	Progress   *JobProgress      `json:"progress,omitempty"`
+	Output     *JobOutput        `json:"output,omitempty"`
+	// DurationMs is the time since the job was started.
+	DurationMs int64     `json:"durationMs"`
+	ErrorCode  string    `json:"errorCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	OccurredAt time.Time `json:"occurredAt"`
+}
+
+// JobProgress counts the finished steps of a job, e.g. renditions.
+type JobProgress struct {
+	Step      string `json:"step"`
+	Completed int    `json:"completed"`
+	Total     int    `json:"total"`
+}
+
+type JobOutput struct {
+	Profile      string     `json:"profile"`
+	Bucket       string     `json:"bucket"`
+	ObjectPrefix string     `json:"objectPrefix"`
+	Keys         []string   `json:"keys"`
+	PlaybackURL  string     `json:"playbackUrl,omitempty"`
+	PosterURL    string     `json:"posterUrl,omitempty"`
+	DownloadURL  string     `json:"downloadUrl,omitempty"`
+	SlidesURL    string     `json:"slidesUrl,omitempty"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+}
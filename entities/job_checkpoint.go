@@ -0,0 +1,21 @@
+package entities
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// JobCheckpoint records a rendition of a job whose output is already stored,
+// so a retried job only encodes what is still missing.
+type JobCheckpoint struct {
+	JobId        uuid.UUID `json:"job_id" gorm:"type:uuid;primaryKey"`
+	Rendition    string    `json:"rendition" gorm:"type:varchar(50);primaryKey"`
+	ObjectPrefix string    `json:"object_prefix" gorm:"type:varchar(500);not null"`
+	SourceHash   string    `json:"source_hash" gorm:"type:char(64)"`
+	MediaInfo    string    `json:"media_info" gorm:"type:text"`
+	CreatedAt    time.Time `json:"created_at" gorm:"type:timestamptz;not null;default:CURRENT_TIMESTAMP"`
+}
+
+func (JobCheckpoint) TableName() string {
+	return "job_checkpoints"
+}
@@ -0,0 +1,25 @@
+package entities
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// JobResult is the completion result of a job: where its output lives and
+// the URLs clients can fetch it from until ExpiresAt.
+type JobResult struct {
+	JobId        uuid.UUID  `json:"job_id" gorm:"type:uuid;primaryKey"`
+	Profile      string     `json:"profile" gorm:"type:varchar(100)"`
+	Bucket       string     `json:"bucket" gorm:"type:varchar(255);not null"`
+	ObjectPrefix string     `json:"object_prefix" gorm:"type:varchar(500);not null"`
+	PlaybackURL  string     `json:"playback_url" gorm:"type:text"`
+	PosterURL    string     `json:"poster_url" gorm:"type:text"`
+	DownloadURL  string     `json:"download_url" gorm:"type:text"`
+	SlidesURL    string     `json:"slides_url" gorm:"type:text"`
+	ExpiresAt    *time.Time `json:"expires_at" gorm:"type:timestamptz"`
+	CreatedAt    time.Time  `json:"created_at" gorm:"type:timestamptz;not null;default:CURRENT_TIMESTAMP"`
+}
+
+func (JobResult) TableName() string {
+	return "job_results"
+}
@@ -0,0 +1,23 @@
+package entities
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// LessonSource records where the original upload of a lesson is retained so
+// it can be re-transcoded later.
+type LessonSource struct {
+	LessonId     uuid.UUID `json:"lesson_id" gorm:"type:uuid;primaryKey"`
+	Profile      string    `json:"profile" gorm:"type:varchar(100)"`
+	Bucket       string    `json:"bucket" gorm:"type:varchar(255);not null"`
+	ObjectKey    string    `json:"object_key" gorm:"type:varchar(1024);not null"`
+	Policy       string    `json:"policy" gorm:"type:varchar(20);not null"`
+	StorageClass string    `json:"storage_class" gorm:"type:varchar(50)"`
+	JobId        uuid.UUID `json:"job_id" gorm:"type:uuid;not null"`
+	UpdatedAt    time.Time `json:"updated_at" gorm:"type:timestamptz;not null;default:CURRENT_TIMESTAMP"`
+}
+
+func (LessonSource) TableName() string {
+	return "lesson_sources"
+}
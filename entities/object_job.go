@@ -0,0 +1,22 @@
+package entities
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// ObjectJob claims an uploaded object version for the job that encodes it, so
+// a bucket notification and a manual job message for the same upload only
+// trigger one encode.
+type ObjectJob struct {
+	Profile   string    `json:"profile" gorm:"type:varchar(100);primaryKey"`
+	Bucket    string    `json:"bucket" gorm:"type:varchar(255);primaryKey"`
+	ObjectKey string    `json:"object_key" gorm:"type:varchar(1024);primaryKey"`
+	ETag      string    `json:"etag" gorm:"type:varchar(100);primaryKey"`
+	JobId     uuid.UUID `json:"job_id" gorm:"type:uuid;not null"`
+	CreatedAt time.Time `json:"created_at" gorm:"type:timestamptz;not null;default:CURRENT_TIMESTAMP"`
+}
+
+func (ObjectJob) TableName() string {
+	return "object_jobs"
+}
@@ -0,0 +1,23 @@
+package entities
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// OutboxEvent is an event waiting to be published to RabbitMQ. It is written
+// in the same transaction as the state change it describes and published by
+// the outbox relay afterwards.
+type OutboxEvent struct {
+	ID         uuid.UUID  `json:"id" gorm:"type:uuid;primaryKey"`
+	RoutingKey string     `json:"routing_key" gorm:"type:varchar(255);not null"`
+	Payload    string     `json:"payload" gorm:"type:jsonb;not null"`
+	Attempts   int        `json:"attempts" gorm:"not null;default:0"`
+	LastError  string     `json:"last_error" gorm:"type:text"`
+	SentAt     *time.Time `json:"sent_at" gorm:"type:timestamptz;index"`
+	CreatedAt  time.Time  `json:"created_at" gorm:"type:timestamptz;not null;default:CURRENT_TIMESTAMP;index"`
+}
+
+func (OutboxEvent) TableName() string {
+	return "outbox_events"
+}
@@ -0,0 +1,22 @@
+package entities
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+type SourceHash struct {
+	Hash          string    `json:"hash" gorm:"type:char(64);primaryKey"`
+	LadderProfile string    `json:"ladder_profile" gorm:"type:varchar(64);primaryKey"`
+	Profile       string    `json:"profile" gorm:"type:varchar(100)"`
+	Bucket        string    `json:"bucket" gorm:"type:varchar(255)"`
+	OutputPrefix  string    `json:"output_prefix" gorm:"type:varchar(500);not null"`
+	HasSlides     bool      `json:"has_slides" gorm:"not null;default:false"`
+	JobId         uuid.UUID `json:"job_id" gorm:"type:uuid;not null"`
+	CreatedAt     time.Time `json:"created_at" gorm:"type:timestamptz;not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt     time.Time `json:"updated_at" gorm:"type:timestamptz;not null;default:CURRENT_TIMESTAMP"`
+}
+
+func (SourceHash) TableName() string {
+	return "source_hashes"
+}
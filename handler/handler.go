@@ -3,22 +3,35 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/rs/zerolog"
 	"worker-transcode/dto"
+	"worker-transcode/pkg/failure"
 	"worker-transcode/service"
 )
 
 type ServiceDependencies struct {
 	TranscodeService      service.Service
 	RecordingMergeService service.RecordingMergeService
+	NotificationService   service.NotificationService
+}
+
+// Handlers maps the handler names of the configured consumers to the
+// functions that process their messages.
+var Handlers = map[string]func(ctx context.Context, msg amqp.Delivery, deps ServiceDependencies) error{
+	"transcode":           JobHandler,
+	"recording_merge":     RecordingMergeHandler,
+	"bucket_notification": BucketNotificationHandler,
 }
 
 func JobHandler(ctx context.Context, msg amqp.Delivery, deps ServiceDependencies) error {
 	var job dto.JobMessage
 	if err := json.Unmarshal(msg.Body, &job); err != nil {
-		return err
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to unmarshal job message")
+		return failure.NewPermanent("malformed_message", err)
 	}
+	job.Redelivered = msg.Redelivered
 
 	err := deps.TranscodeService.Process(ctx, job)
 	if err != nil {
@@ -32,7 +45,7 @@ func RecordingMergeHandler(ctx context.Context, msg amqp.Delivery, deps ServiceD
 	var recordingMsg dto.RecordingMergeMessage
 	if err := json.Unmarshal(msg.Body, &recordingMsg); err != nil {
 		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to unmarshal recording merge message")
-		return err
+		return failure.NewPermanent("malformed_message", err)
 	}
 
 	zerolog.Ctx(ctx).Info().
@@ -47,3 +60,23 @@ func RecordingMergeHandler(ctx context.Context, msg amqp.Delivery, deps ServiceD
 
 	return nil
 }
+
+func BucketNotificationHandler(ctx context.Context, msg amqp.Delivery, deps ServiceDependencies) error {
+	var event dto.BucketEvent
+	if err := json.Unmarshal(msg.Body, &event); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to unmarshal bucket notification")
+		return failure.NewPermanent("malformed_message", err)
+	}
+	event.Redelivered = msg.Redelivered
+
+	zerolog.Ctx(ctx).Info().
+		Str("event", event.EventName).
+		Str("key", event.Key).
+		Msg("received bucket notification")
+
+	if deps.NotificationService == nil {
+		return failure.NewPermanent("notifications_not_configured", errors.New("bucket notifications are not configured"))
+	}
+
+	return deps.NotificationService.HandleBucketEvent(ctx, event)
+}
@@ -0,0 +1,139 @@
+package failure
+
+import (
+	"context"
+	"errors"
+)
+
+// Kind classifies a handler error so the consumer can decide between
+// dead-lettering, retrying and requeueing the message.
+type Kind int
+
+const (
+	// Transient failures may succeed on a later attempt and are retried.
+	// Unclassified errors are transient.
+	Transient Kind = iota
+	// Permanent failures fail every attempt, the message is dead-lettered.
+	Permanent
+	// ResourceExhausted failures wait for a resource of this worker, e.g.
+	// scratch space, and are requeued without counting an attempt until the
+	// resource retries are used up.
+	ResourceExhausted
+	// Cancelled handlers were interrupted, e.g. by a shutdown, and the message
+	// is handed back to the broker.
+	Cancelled
+	// Waiting failures wait for another job to finish. They are delayed like
+	// resource failures but count neither an attempt nor a resource retry,
+	// the handler bounds the wait itself.
+	Waiting
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Permanent:
+		return "permanent"
+	case ResourceExhausted:
+		return "resource_exhausted"
+	case Cancelled:
+		return "cancelled"
+	case Waiting:
+		return "waiting"
+	default:
+		return "transient"
+	}
+}
+
+// Error attaches a kind and a short machine-readable reason to an error.
+type Error struct {
+	Kind   Kind
+	Reason string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return e.Reason + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func New(kind Kind, reason string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &Error{Kind: kind, Reason: reason, Err: err}
+}
+
+func NewPermanent(reason string, err error) error {
+	return New(Permanent, reason, err)
+}
+
+func NewTransient(reason string, err error) error {
+	return New(Transient, reason, err)
+}
+
+func NewResourceExhausted(reason string, err error) error {
+	return New(ResourceExhausted, reason, err)
+}
+
+func NewWaiting(reason string, err error) error {
+	return New(Waiting, reason, err)
+}
+
+// KindOf returns the kind of the outermost classified error in the chain of
+// err. Context cancellation is classified as cancelled.
+func KindOf(err error) Kind {
+	var classified *Error
+	if errors.As(err, &classified) {
+		return classified.Kind
+	}
+	if errors.Is(err, context.Canceled) {
+		return Cancelled
+	}
+
+	return Transient
+}
+
+type lastDeliveryKey struct{}
+
+type lastDelivery struct {
+	attempt  bool
+	resource bool
+}
+
+// WithLastDelivery records on ctx whether the consumer gives up on the message
+// after a transient failure (lastAttempt) or after a resource failure
+// (lastResource), instead of delivering it again.
+func WithLastDelivery(ctx context.Context, lastAttempt, lastResource bool) context.Context {
+	return context.WithValue(ctx, lastDeliveryKey{}, lastDelivery{attempt: lastAttempt, resource: lastResource})
+}
+
+// Final reports whether failing with err ends the handling of the message, so
+// the handler has to record the failure itself. Without WithLastDelivery only
+// permanent failures are final.
+func Final(ctx context.Context, err error) bool {
+	last, _ := ctx.Value(lastDeliveryKey{}).(lastDelivery)
+	switch KindOf(err) {
+	case Permanent:
+		return true
+	case ResourceExhausted:
+		return last.resource
+	case Cancelled, Waiting:
+		return false
+	default:
+		return last.attempt
+	}
+}
+
+// ReasonOf returns the reason of the outermost classified error in the chain
+// of err, or the name of its kind.
+func ReasonOf(err error) string {
+	var classified *Error
+	if errors.As(err, &classified) && classified.Reason != "" {
+		return classified.Reason
+	}
+
+	return KindOf(err).String()
+}
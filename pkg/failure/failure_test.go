@@ -0,0 +1,94 @@
+package failure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestKindOf(t *testing.T) {
+	cause := errors.New("boom")
+	tests := []struct {
+		name string
+		err  error
+		kind Kind
+	}{
+		{"unclassified", cause, Transient},
+		{"permanent", NewPermanent("malformed_message", cause), Permanent},
+		{"resource", NewResourceExhausted("insufficient_scratch_space", cause), ResourceExhausted},
+		{"wrapped", fmt.Errorf("handling: %w", NewPermanent("job_not_found", cause)), Permanent},
+		{"outermost wins", NewTransient("retry", NewPermanent("inner", cause)), Transient},
+		{"waiting", NewWaiting("source_claimed", cause), Waiting},
+		{"context canceled", fmt.Errorf("ffmpeg: %w", context.Canceled), Cancelled},
+		{"classified cancellation", NewPermanent("inner", context.Canceled), Permanent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := KindOf(tt.err); got != tt.kind {
+				t.Errorf("KindOf() = %s, want %s", got, tt.kind)
+			}
+		})
+	}
+}
+
+func TestReasonOf(t *testing.T) {
+	cause := errors.New("boom")
+	tests := []struct {
+		name   string
+		err    error
+		reason string
+	}{
+		{"classified", NewPermanent("malformed_message", cause), "malformed_message"},
+		{"empty reason", New(ResourceExhausted, "", cause), "resource_exhausted"},
+		{"unclassified", cause, "transient"},
+		{"cancelled", context.Canceled, "cancelled"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ReasonOf(tt.err); got != tt.reason {
+				t.Errorf("ReasonOf() = %q, want %q", got, tt.reason)
+			}
+		})
+	}
+}
+
+func TestNewNil(t *testing.T) {
+	if err := NewPermanent("reason", nil); err != nil {
+		t.Errorf("NewPermanent(nil) = %v, want nil", err)
+	}
+}
+
+func TestFinal(t *testing.T) {
+	cause := errors.New("boom")
+	tests := []struct {
+		name         string
+		lastAttempt  bool
+		lastResource bool
+		err          error
+		final        bool
+	}{
+		{"permanent", false, false, NewPermanent("reason", cause), true},
+		{"transient", false, false, cause, false},
+		{"transient on last attempt", true, false, cause, true},
+		{"resource", true, false, NewResourceExhausted("reason", cause), false},
+		{"resource on last retry", false, true, NewResourceExhausted("reason", cause), true},
+		{"cancelled", true, true, context.Canceled, false},
+		{"waiting", true, true, NewWaiting("reason", cause), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := WithLastDelivery(context.Background(), tt.lastAttempt, tt.lastResource)
+			if got := Final(ctx, tt.err); got != tt.final {
+				t.Errorf("Final() = %v, want %v", got, tt.final)
+			}
+		})
+	}
+
+	if Final(context.Background(), cause) {
+		t.Error("Final() without WithLastDelivery = true for a transient error")
+	}
+}
@@ -0,0 +1,120 @@
+package rabbitmq
+
+import (
+	"context"
+	"github.com/cenkalti/backoff/v5"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/rs/zerolog"
+	"sync"
+	"time"
+	"worker-transcode/config"
+)
+
+// Connection keeps a connection to the broker open and redials it whenever
+// the broker closes it, e.g. on a restart.
+type Connection struct {
+	url string
+
+	mu   sync.Mutex
+	conn *amqp.Connection
+	// connected is closed while conn is usable and replaced once it is lost.
+	connected chan struct{}
+}
+
+// Run dials the broker and supervises the connection until ctx is done.
+func (c *Connection) Run(ctx context.Context) {
+	for {
+		conn, err := c.dial(ctx)
+		if err != nil {
+			return
+		}
+
+		closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		c.mu.Lock()
+		c.conn = conn
+		close(c.connected)
+		c.mu.Unlock()
+		zerolog.Ctx(ctx).Info().Msg("Successfully connected to RabbitMQ")
+
+		select {
+		case <-ctx.Done():
+			if err := conn.Close(); err != nil {
+				zerolog.Ctx(ctx).Error().Err(err).Msg("Failed to close RabbitMQ connection")
+			}
+			zerolog.Ctx(ctx).Info().Msg("RabbitMQ connection closed")
+			return
+		case amqpErr := <-closed:
+			zerolog.Ctx(ctx).Warn().Err(amqpErr).Msg("RabbitMQ connection lost, reconnecting")
+			c.mu.Lock()
+			c.conn = nil
+			c.connected = make(chan struct{})
+			c.mu.Unlock()
+		}
+	}
+}
+
+// dial retries until the broker accepts the connection or ctx is done.
+func (c *Connection) dial(ctx context.Context) (*amqp.Connection, error) {
+	operation := func() (*amqp.Connection, error) {
+		conn, err := amqp.Dial(c.url)
+		if err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Msg("Failed to connect to RabbitMQ. Retrying...")
+			return nil, err
+		}
+
+		return conn, nil
+	}
+
+	bo := backoff.NewExponentialBackOff()
+	bo.MaxInterval = 10 * time.Second
+	return backoff.Retry(ctx, operation, backoff.WithBackOff(bo), backoff.WithMaxElapsedTime(0))
+}
+
+// Channel opens a channel, waiting for the connection to be (re)established.
+func (c *Connection) Channel(ctx context.Context) (*amqp.Channel, error) {
+	for {
+		c.mu.Lock()
+		conn, connected := c.conn, c.connected
+		c.mu.Unlock()
+
+		if conn != nil {
+			ch, err := conn.Channel()
+			if err == nil {
+				return ch, nil
+			}
+			if !conn.IsClosed() {
+				return nil, err
+			}
+
+			// The connection was lost before Run noticed, give it a moment
+			// to start redialing.
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		select {
+		case <-connected:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Connected reports whether the broker connection is currently open.
+func (c *Connection) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn != nil && !c.conn.IsClosed()
+}
+
+func NewConnection(cfg *config.RabbitMQ) *Connection {
+	return &Connection{
+		url:       cfg.URL(),
+		connected: make(chan struct{}),
+	}
+}
@@ -2,155 +2,446 @@ package rabbitmq
 
 import (
 	"context"
+	"errors"
 	"github.com/cenkalti/backoff/v5"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/rs/zerolog"
 	"sync"
+	"sync/atomic"
 	"time"
 	"worker-transcode/config"
+	"worker-transcode/pkg/failure"
 )
 
 type Consumer[T any] interface {
+	// Consume runs until ctx is done, resubscribing whenever the channel or
+	// the connection to the broker is lost.
 	Consume(ctx context.Context, dependencies T) error
+	Queue() string
+	// Consuming reports whether the consumer is currently subscribed.
+	Consuming() bool
+}
+
+// Handler processes one delivery. What happens to the message on a returned
+// error depends on its failure kind: transient errors are retried through a
+// retry queue until the attempts are used up, permanent errors are
+// dead-lettered right away, resource errors are delayed without counting an
+// attempt up to their own limit, waiting ones are delayed without any limit
+// and cancelled ones are requeued.
+type Handler[T any] func(ctx context.Context, msg amqp.Delivery, dependencies T) error
+
+// delivery is a message together with the channel it was received on, which
+// republishes it for a retry, and the queue it came from.
+type delivery struct {
+	amqp.Delivery
+	ch    *amqp.Channel
+	queue config.ConsumerQueue
 }
 
 type consumer[T any] struct {
-	conn       *amqp.Connection
-	cfg        *config.RabbitMQ
-	handler    func(ctx context.Context, msg amqp.Delivery, dependencies T) error
-	numWorkers int
+	conn    *Connection
+	cfg     *config.RabbitMQ
+	queue   config.ConsumerQueue
+	handler Handler[T]
+	// ready blocks until the worker can take on another job, e.g. while the
+	// scratch volume is low on space.
+	ready     func(ctx context.Context) error
+	consuming atomic.Bool
+}
+
+func (c *consumer[T]) Queue() string {
+	return c.queue.Queue
+}
+
+func (c *consumer[T]) Consuming() bool {
+	return c.consuming.Load()
+}
+
+// highQueue is the queue high priority messages are routed to, which only
+// exists with reserved workers.
+func highQueue(queue config.ConsumerQueue) config.ConsumerQueue {
+	queue.Queue += ".high"
+	queue.RoutingKey = queue.Priority.HighRoutingKey
+	return queue
 }
 
-func (c consumer[T]) Consume(ctx context.Context, dependencies T) error {
-	ch, err := c.conn.Channel()
+func (c *consumer[T]) Consume(ctx context.Context, dependencies T) error {
+	jobs := make(chan delivery)
+	highJobs := make(chan delivery)
+	var wg sync.WaitGroup
+	defer func() {
+		close(jobs)
+		close(highJobs)
+		wg.Wait()
+	}()
+
+	// The workers outlive a lost channel, deliveries they still hold can not
+	// be acknowledged any more and are redelivered by the broker. Reserved
+	// workers only take high priority messages, the others prefer them.
+	reserved := c.queue.Priority.ReservedWorkers
+	for i := 1; i <= c.queue.Workers; i++ {
+		wg.Add(1)
+		go func(workerId int) {
+			defer wg.Done()
+			if workerId <= reserved {
+				for msg := range highJobs {
+					c.handle(ctx, workerId, msg, dependencies)
+				}
+				return
+			}
+
+			for {
+				msg, ok := next(highJobs, jobs)
+				if !ok {
+					return
+				}
+				c.handle(ctx, workerId, msg, dependencies)
+			}
+		}(i)
+	}
+
+	bo := backoff.NewExponentialBackOff()
+	bo.MaxInterval = 30 * time.Second
+	for {
+		subscribed, err := c.session(ctx, jobs, highJobs)
+		c.consuming.Store(false)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if subscribed {
+			bo.Reset()
+		}
+
+		wait := bo.NextBackOff()
+		zerolog.Ctx(ctx).Warn().Err(err).Str("queue", c.queue.Queue).Dur("retry_in", wait).Msg("consumer lost its channel, resubscribing")
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// next takes a job, from high first when both have one. It reports false once
+// the jobs are closed.
+func next(high, jobs <-chan delivery) (delivery, bool) {
+	select {
+	case msg, ok := <-high:
+		return msg, ok
+	default:
+	}
+
+	select {
+	case msg, ok := <-high:
+		return msg, ok
+	case msg, ok := <-jobs:
+		return msg, ok
+	}
+}
+
+// session consumes on a fresh channel until the channel is closed. It reports
+// whether the subscription was established.
+func (c *consumer[T]) session(ctx context.Context, jobs, highJobs chan<- delivery) (bool, error) {
+	ch, err := c.conn.Channel(ctx)
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer ch.Close()
 
-	exchangeName := "transcoding_exchange"
-	queueName := "transcoding_queue"
-	routingKey := "video.transcoding.request"
-	dlxName := "transcoding_exchange_dlx"
-	dlqName := "transcoding_queue_dlq"
-	dlqRoutingKey := "dlq.video.transcoding.request"
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	deliveries, highDeliveries, err := c.subscribe(ctx, ch)
+	if err != nil {
+		return false, err
+	}
+	c.consuming.Store(true)
+
+	if highDeliveries != nil {
+		var pumps sync.WaitGroup
+		pumps.Add(1)
+		go func() {
+			defer pumps.Done()
+			if err := c.pump(ctx, ch, highQueue(c.queue), highDeliveries, highJobs); err != nil && ctx.Err() == nil {
+				zerolog.Ctx(ctx).Debug().Err(err).Str("queue", highQueue(c.queue).Queue).Msg("stopped taking high priority messages")
+			}
+		}()
+		// The jobs are closed once the session returns, so the pump has to
+		// end before, which closing the channel makes it do.
+		defer func() {
+			ch.Close()
+			pumps.Wait()
+		}()
+	}
+
+	if err := c.pump(ctx, ch, c.queue, deliveries, jobs); !errors.Is(err, amqp.ErrClosed) {
+		return true, err
+	}
+	if amqpErr, ok := <-closed; ok && amqpErr != nil {
+		return true, amqpErr
+	}
+
+	return true, amqp.ErrClosed
+}
+
+// pump hands the deliveries of queue to jobs while the worker is ready. It
+// returns amqp.ErrClosed once the deliveries end with the channel.
+func (c *consumer[T]) pump(ctx context.Context, ch *amqp.Channel, queue config.ConsumerQueue, deliveries <-chan amqp.Delivery, jobs chan<- delivery) error {
+	for {
+		if c.ready != nil {
+			if err := c.ready(ctx); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case msg, ok := <-deliveries:
+			if !ok {
+				return amqp.ErrClosed
+			}
+
+			// Retries republish with the priority, also when it came from
+			// the body.
+			msg.Priority = messagePriority(msg)
+			select {
+			case jobs <- delivery{Delivery: msg, ch: ch, queue: queue}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *consumer[T]) handle(ctx context.Context, workerId int, msg delivery, dependencies T) {
+	handlerCtx := failure.WithLastDelivery(ctx,
+		attempt(msg.Delivery) >= c.queue.Retry.MaxAttempts,
+		resourceRetries(msg.Delivery) >= c.queue.Retry.MaxResourceRetries)
+	err := c.handler(handlerCtx, msg.Delivery, dependencies)
+	if err == nil {
+		if ackErr := msg.Ack(false); ackErr != nil {
+			zerolog.Ctx(ctx).Error().Err(ackErr).Msg("failed to acknowledge message")
+		}
+		return
+	}
 
-	err = ch.ExchangeDeclare(exchangeName, c.cfg.Kind, true, false, false, false, nil)
+	n := attempt(msg.Delivery)
+	logger := zerolog.Ctx(ctx).With().
+		Str("queue", msg.queue.Queue).
+		Int("worker_id", workerId).
+		Int("attempt", n).
+		Str("failure", failure.KindOf(err).String()).
+		Logger()
+
+	switch failure.KindOf(err) {
+	case failure.Cancelled:
+		logger.Warn().Err(err).Msg("message handling was cancelled, requeueing")
+		c.requeue(ctx, msg)
+	case failure.Permanent:
+		logger.Error().Err(err).Msg("message failed permanently, dead-lettering")
+		c.deadLetter(ctx, msg, failure.ReasonOf(err), err)
+	case failure.ResourceExhausted:
+		retries := resourceRetries(msg.Delivery)
+		if retries >= c.queue.Retry.MaxResourceRetries {
+			logger.Error().Err(err).Int("resource_retries", retries).Msg("worker lacked resources for message too often, dead-lettering")
+			c.deadLetter(ctx, msg, "max_resource_retries_exceeded", err)
+			return
+		}
+
+		logger.Warn().Err(err).Dur("retry_in", c.queue.Retry.ResourceDelay).Msg("worker lacks resources for message, delaying")
+		c.retry(ctx, msg, c.queue.Retry.ResourceDelay, amqp.Table{ResourceRetryHeader: int32(retries + 1)})
+	case failure.Waiting:
+		logger.Info().Err(err).Dur("retry_in", c.queue.Retry.ResourceDelay).Msg("message waits for another job, delaying")
+		c.retry(ctx, msg, c.queue.Retry.ResourceDelay, nil)
+	default:
+		if n >= c.queue.Retry.MaxAttempts {
+			logger.Error().Err(err).Msg("failed to handle message after all attempts")
+			c.deadLetter(ctx, msg, "max_attempts_exceeded", err)
+			return
+		}
+
+		delay := retryDelay(c.queue.Retry, n)
+		logger.Warn().Err(err).Dur("retry_in", delay).Msg("failed to handle message, scheduling retry")
+		c.retry(ctx, msg, delay, amqp.Table{AttemptHeader: int32(n + 1)})
+	}
+}
+
+// retry acknowledges msg once a copy with the headers in set is confirmed in
+// the retry queue for delay, which returns it to the queue it came from.
+func (c *consumer[T]) retry(ctx context.Context, msg delivery, delay time.Duration, set amqp.Table) {
+	if err := republish(ctx, msg.ch, msg.queue, msg.Delivery, delay, set); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to schedule retry, requeueing message")
+		c.requeue(ctx, msg)
+		return
+	}
+	if err := msg.Ack(false); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to acknowledge retried message")
+	}
+}
+
+// deadLetter acknowledges msg once a copy carrying the failure headers is
+// confirmed in the dead letter exchange. Without a confirmed copy msg is
+// rejected and dead-lettered by the broker, without the headers.
+func (c *consumer[T]) deadLetter(ctx context.Context, msg delivery, reason string, cause error) {
+	if err := deadLetter(ctx, msg.ch, msg.queue, msg.Delivery, reason, cause); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to publish to DLQ, rejecting message")
+		if nackErr := msg.Nack(false, false); nackErr != nil {
+			zerolog.Ctx(ctx).Error().Err(nackErr).Msg("failed to nack message to send to DLQ")
+		}
+		return
+	}
+	if err := msg.Ack(false); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to acknowledge dead-lettered message")
+	}
+}
+
+// requeue hands msg back to the broker without counting an attempt.
+func (c *consumer[T]) requeue(ctx context.Context, msg delivery) {
+	if err := msg.Nack(false, true); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to requeue message")
+	}
+}
+
+// subscribe declares the topology of the queue on ch and starts consuming it,
+// and with reserved workers its high priority queue as well.
+func (c *consumer[T]) subscribe(ctx context.Context, ch *amqp.Channel) (<-chan amqp.Delivery, <-chan amqp.Delivery, error) {
+	var err error
+
+	exchangeName := c.queue.Exchange
+	queueName := c.queue.Queue
+	routingKey := c.queue.RoutingKey
+	dlxName := c.queue.DeadLetter.Exchange
+	dlqName := c.queue.DeadLetter.Queue
+	dlqRoutingKey := c.queue.DeadLetter.RoutingKey
+
+	err = ch.ExchangeDeclare(exchangeName, c.queue.ExchangeKind, true, false, false, false, nil)
 	if err != nil {
-		zerolog.Ctx(ctx).Error().Str("queue", queueName).Msg("failed to declare exchange")
-		return err
+		zerolog.Ctx(ctx).Error().Str("exchange", exchangeName).Msg("failed to declare exchange")
+		return nil, nil, err
 	}
 
+	// Dead letter exchanges may be shared between queues, so they always use
+	// the default kind.
 	err = ch.ExchangeDeclare(dlxName, c.cfg.Kind, true, false, false, false, nil)
 	if err != nil {
-		zerolog.Ctx(ctx).Error().Msg("failed to declare dlx")
-		return err
+		zerolog.Ctx(ctx).Error().Str("exchange", dlxName).Msg("failed to declare dlx")
+		return nil, nil, err
 	}
 
 	dlq, err := ch.QueueDeclare(dlqName, true, false, false, false, nil)
 	if err != nil {
-		zerolog.Ctx(ctx).Error().Msg("failed to declare dlq")
-		return err
+		zerolog.Ctx(ctx).Error().Str("queue", dlqName).Msg("failed to declare dlq")
+		return nil, nil, err
 	}
 
 	err = ch.QueueBind(dlq.Name, dlqRoutingKey, dlxName, false, nil)
 	if err != nil {
-		zerolog.Ctx(ctx).Error().Msg("failed to bind dlq")
-		return err
+		zerolog.Ctx(ctx).Error().Str("queue", dlqName).Msg("failed to bind dlq")
+		return nil, nil, err
 	}
 
-	args := amqp.Table{
-		"x-dead-letter-exchange":    dlxName,
-		"x-dead-letter-routing-key": dlqRoutingKey,
+	queues := []config.ConsumerQueue{c.queue}
+	if c.queue.Priority.ReservedWorkers > 0 {
+		queues = append(queues, highQueue(c.queue))
 	}
-	q, err := ch.QueueDeclare(queueName, true, false, false, false, args)
-	if err != nil {
-		zerolog.Ctx(ctx).Error().Str("queue", queueName).Msg("failed to declare queue")
-		return err
+	for _, queue := range queues {
+		if err := c.declareQueue(ch, queue); err != nil {
+			zerolog.Ctx(ctx).Error().Str("queue", queue.Queue).Msg("failed to declare queue")
+			return nil, nil, err
+		}
 	}
 
-	err = ch.QueueBind(q.Name, routingKey, exchangeName, false, nil)
+	// Retries are republished on this channel and only acknowledged once
+	// the broker confirmed the copy.
+	err = ch.Confirm(false)
 	if err != nil {
-		zerolog.Ctx(ctx).Error().Str("queue", queueName).Msg("failed to bind queue")
-		return err
+		zerolog.Ctx(ctx).Error().Str("queue", queueName).Msg("failed to enable publisher confirms")
+		return nil, nil, err
 	}
 
-	err = ch.Qos(c.numWorkers, 0, false)
+	// The prefetch applies to each consumer started after it. The reserved
+	// workers get their own on the high priority queue, so a saturated queue
+	// can not take their capacity.
+	err = ch.Qos(max(c.queue.Prefetch-c.queue.Priority.ReservedWorkers, 1), 0, false)
 	if err != nil {
 		zerolog.Ctx(ctx).Error().Str("queue", queueName).Msg("failed to set QoS")
-		return err
+		return nil, nil, err
 	}
 
 	deliveries, err := ch.Consume(queueName, "", false, false, false, false, nil)
 	if err != nil {
 		zerolog.Ctx(ctx).Error().Str("queue", queueName).Msg("failed to consume queue")
-		return err
+		return nil, nil, err
 	}
 
-	jobs := make(chan amqp.Delivery, c.numWorkers)
-	var wg sync.WaitGroup
-	for i := 1; i <= c.numWorkers; i++ {
-		wg.Add(1)
-		go func(workerId int) {
-			defer wg.Done()
-			for msg := range jobs {
-				operation := func() (string, error) {
-					err := c.handler(ctx, msg, dependencies)
-					if err != nil {
-						return "", err
-					}
-					return "", nil
-				}
+	var highDeliveries <-chan amqp.Delivery
+	if len(queues) > 1 {
+		high := queues[1]
+		err = ch.Qos(high.Priority.ReservedWorkers, 0, false)
+		if err != nil {
+			zerolog.Ctx(ctx).Error().Str("queue", high.Queue).Msg("failed to set QoS")
+			return nil, nil, err
+		}
 
-				bo := backoff.NewExponentialBackOff()
-				bo.MaxInterval = 10 * time.Second
-
-				_, err := backoff.Retry(ctx, operation, backoff.WithBackOff(bo), backoff.WithMaxTries(5))
-				if err != nil {
-					zerolog.Ctx(ctx).Error().Err(err).Msg("failed to handle message after all retries")
-					if nackErr := msg.Nack(false, false); nackErr != nil {
-						zerolog.Ctx(ctx).Error().Err(nackErr).Msg("failed to nack message to send to DLQ")
-					}
-				} else {
-					if ackErr := msg.Ack(false); ackErr != nil {
-						zerolog.Ctx(ctx).Error().Err(ackErr).Msg("failed to acknowledge message")
-					}
-				}
-			}
-		}(i)
+		highDeliveries, err = ch.Consume(high.Queue, "", false, false, false, false, nil)
+		if err != nil {
+			zerolog.Ctx(ctx).Error().Str("queue", high.Queue).Msg("failed to consume queue")
+			return nil, nil, err
+		}
 	}
 
-	for {
-		select {
-		case delivery, ok := <-deliveries:
-			if !ok {
-				close(jobs)
-				wg.Wait()
-				return nil
-			}
+	zerolog.Ctx(ctx).Info().
+		Str("handler", c.queue.Handler).
+		Str("queue", queueName).
+		Str("exchange", exchangeName).
+		Str("routing_key", routingKey).
+		Str("high_routing_key", c.queue.Priority.HighRoutingKey).
+		Int("workers", c.queue.Workers).
+		Int("reserved_workers", c.queue.Priority.ReservedWorkers).
+		Msg("consumer started")
 
-			jobs <- delivery
-		case <-ctx.Done():
-			close(jobs)
-			wg.Wait()
-			return ctx.Err()
-		}
+	return deliveries, highDeliveries, nil
+}
+
+// declareQueue declares queue with its retry queues and binds it to its
+// exchange.
+func (c *consumer[T]) declareQueue(ch *amqp.Channel, queue config.ConsumerQueue) error {
+	args := amqp.Table{
+		"x-dead-letter-exchange":    queue.DeadLetter.Exchange,
+		"x-dead-letter-routing-key": queue.DeadLetter.RoutingKey,
+	}
+	if queue.Priority.MaxPriority > 0 {
+		args["x-max-priority"] = queue.Priority.MaxPriority
 	}
+	q, err := ch.QueueDeclare(queue.Queue, true, false, false, false, args)
+	if err != nil {
+		return err
+	}
+
+	if err := ch.QueueBind(q.Name, queue.RoutingKey, queue.Exchange, false, nil); err != nil {
+		return err
+	}
+
+	return declareRetryQueues(ch, queue)
 }
 
 func NewConsumer[T any](
-	conn *amqp.Connection,
+	conn *Connection,
 	cfg *config.RabbitMQ,
-	numWorkers int,
-	handler func(ctx context.Context, msg amqp.Delivery, dependencies T) error,
+	queue config.ConsumerQueue,
+	ready func(ctx context.Context) error,
+	handler Handler[T],
 ) Consumer[T] {
-	if numWorkers < 1 {
-		numWorkers = 1
+	if queue.Workers < 1 {
+		queue.Workers = 1
+	}
+	if queue.Prefetch < 1 {
+		queue.Prefetch = queue.Workers
 	}
 	return &consumer[T]{
-		conn:       conn,
-		cfg:        cfg,
-		handler:    handler,
-		numWorkers: numWorkers,
+		conn:    conn,
+		cfg:     cfg,
+		queue:   queue,
+		handler: handler,
+		ready:   ready,
 	}
 }
@@ -0,0 +1,22 @@
+package rabbitmq
+
+import (
+	"encoding/json"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// messagePriority returns the AMQP priority of msg, falling back to the
+// priority field of a JSON body for publishers that only set that.
+func messagePriority(msg amqp.Delivery) uint8 {
+	if msg.Priority > 0 {
+		return msg.Priority
+	}
+
+	var body struct {
+		Priority uint8 `json:"priority"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return 0
+	}
+	return body.Priority
+}
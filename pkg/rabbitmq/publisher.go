@@ -0,0 +1,90 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"sync"
+)
+
+// ErrNotConfirmed is returned when the broker nacks a message or the channel
+// closes before confirming it.
+var ErrNotConfirmed = errors.New("message not confirmed by the broker")
+
+// Publisher publishes to one exchange on a channel in confirm mode, reopening
+// the channel when it was lost.
+type Publisher struct {
+	conn     *Connection
+	exchange string
+	kind     string
+
+	mu sync.Mutex
+	ch *amqp.Channel
+}
+
+// Publish sends msg and waits until the broker confirms it.
+func (p *Publisher) Publish(ctx context.Context, routingKey string, msg amqp.Publishing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ch, err := p.channel(ctx)
+	if err != nil {
+		return err
+	}
+
+	if msg.DeliveryMode == 0 {
+		msg.DeliveryMode = amqp.Persistent
+	}
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx, p.exchange, routingKey, false, false, msg)
+	if err != nil {
+		p.reset()
+		return err
+	}
+
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return ErrNotConfirmed
+	}
+
+	return nil
+}
+
+func (p *Publisher) channel(ctx context.Context) (*amqp.Channel, error) {
+	if p.ch != nil && !p.ch.IsClosed() {
+		return p.ch, nil
+	}
+
+	ch, err := p.conn.Channel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	if err = ch.ExchangeDeclare(p.exchange, p.kind, true, false, false, false, nil); err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	p.ch = ch
+	return ch, nil
+}
+
+func (p *Publisher) reset() {
+	if p.ch != nil {
+		p.ch.Close()
+		p.ch = nil
+	}
+}
+
+func NewPublisher(conn *Connection, exchange, kind string) *Publisher {
+	return &Publisher{
+		conn:     conn,
+		exchange: exchange,
+		kind:     kind,
+	}
+}
@@ -0,0 +1,151 @@
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"time"
+	"worker-transcode/config"
+	"worker-transcode/pkg/failure"
+)
+
+const (
+	// AttemptHeader counts the deliveries of a message, the first delivery
+	// has no header and is attempt 1.
+	AttemptHeader = "x-attempt"
+	// ResourceRetryHeader counts the resource delays of a message, which do
+	// not count as attempts.
+	ResourceRetryHeader = "x-resource-retry"
+	// The failure headers are set on dead-lettered messages.
+	FailureKindHeader   = "x-failure-kind"
+	FailureReasonHeader = "x-failure-reason"
+	FailureErrorHeader  = "x-failure-error"
+	FailureQueueHeader  = "x-failure-queue"
+)
+
+// retryQueueName names the queue holding messages of queue for delay, e.g.
+// transcoding_queue.retry.1m0s.
+func retryQueueName(queue string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%s", queue, delay)
+}
+
+// declareRetryQueues declares one queue per delay whose expired messages are
+// dead-lettered through the default exchange straight back to the queue.
+func declareRetryQueues(ch *amqp.Channel, queue config.ConsumerQueue) error {
+	delays := append([]time.Duration{queue.Retry.ResourceDelay}, queue.Retry.Delays...)
+	for _, delay := range delays {
+		args := amqp.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queue.Queue,
+		}
+		if _, err := ch.QueueDeclare(retryQueueName(queue.Queue, delay), true, false, false, false, args); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// attempt returns the delivery count of msg from its AttemptHeader.
+func attempt(msg amqp.Delivery) int {
+	return headerCount(msg, AttemptHeader, 1)
+}
+
+// resourceRetries returns how often msg was delayed for lack of a resource.
+func resourceRetries(msg amqp.Delivery) int {
+	return headerCount(msg, ResourceRetryHeader, 0)
+}
+
+func headerCount(msg amqp.Delivery, header string, missing int) int {
+	switch v := msg.Headers[header].(type) {
+	case int:
+		return v
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int16:
+		return int(v)
+	case int8:
+		return int(v)
+	default:
+		return missing
+	}
+}
+
+// retryDelay is the delay before the attempt following attempt.
+func retryDelay(retry config.Retry, attempt int) time.Duration {
+	return retry.Delays[min(attempt, len(retry.Delays))-1]
+}
+
+// republish publishes a copy of msg with the headers in set replaced to the
+// retry queue for delay and waits for the broker to confirm it.
+func republish(ctx context.Context, ch *amqp.Channel, queue config.ConsumerQueue, msg amqp.Delivery, delay time.Duration, set amqp.Table) error {
+	headers := copyHeaders(msg.Headers)
+	for k, v := range set {
+		headers[k] = v
+	}
+
+	return publishConfirmed(ctx, ch, "", retryQueueName(queue.Queue, delay), msg, headers)
+}
+
+// deadLetter publishes a copy of msg describing cause to the dead letter
+// exchange of the queue and waits for the broker to confirm it.
+func deadLetter(ctx context.Context, ch *amqp.Channel, queue config.ConsumerQueue, msg amqp.Delivery, reason string, cause error) error {
+	headers := copyHeaders(msg.Headers)
+	headers[FailureKindHeader] = failure.KindOf(cause).String()
+	headers[FailureReasonHeader] = reason
+	headers[FailureErrorHeader] = truncate(cause.Error(), maxFailureErrorLength)
+	headers[FailureQueueHeader] = queue.Queue
+
+	return publishConfirmed(ctx, ch, queue.DeadLetter.Exchange, queue.DeadLetter.RoutingKey, msg, headers)
+}
+
+// maxFailureErrorLength keeps error headers well below the frame size.
+const maxFailureErrorLength = 1024
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+func copyHeaders(headers amqp.Table) amqp.Table {
+	copied := make(amqp.Table, len(headers)+4)
+	for k, v := range headers {
+		copied[k] = v
+	}
+	return copied
+}
+
+func publishConfirmed(ctx context.Context, ch *amqp.Channel, exchange, routingKey string, msg amqp.Delivery, headers amqp.Table) error {
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx, exchange, routingKey, false, false, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	})
+	if err != nil {
+		return err
+	}
+
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return ErrNotConfirmed
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package rabbitmq
+
+import (
+	amqp "github.com/rabbitmq/amqp091-go"
+	"testing"
+	"time"
+	"worker-transcode/config"
+)
+
+func TestRetryDelay(t *testing.T) {
+	retry := config.Retry{Delays: []time.Duration{10 * time.Second, time.Minute, 5 * time.Minute}}
+	tests := []struct {
+		attempt int
+		delay   time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, time.Minute},
+		{3, 5 * time.Minute},
+		{4, 5 * time.Minute},
+		{10, 5 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := retryDelay(retry, tt.attempt); got != tt.delay {
+			t.Errorf("retryDelay(%d) = %s, want %s", tt.attempt, got, tt.delay)
+		}
+	}
+}
+
+func TestRetryQueueName(t *testing.T) {
+	if got := retryQueueName("transcoding_queue", time.Minute); got != "transcoding_queue.retry.1m0s" {
+		t.Errorf("retryQueueName() = %q", got)
+	}
+}
+
+func TestAttempt(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers amqp.Table
+		attempt int
+	}{
+		{"no headers", nil, 1},
+		{"int32", amqp.Table{AttemptHeader: int32(3)}, 3},
+		{"int64", amqp.Table{AttemptHeader: int64(4)}, 4},
+		{"int16", amqp.Table{AttemptHeader: int16(2)}, 2},
+		{"not a number", amqp.Table{AttemptHeader: "2"}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := attempt(amqp.Delivery{Headers: tt.headers}); got != tt.attempt {
+				t.Errorf("attempt() = %d, want %d", got, tt.attempt)
+			}
+		})
+	}
+}
+
+func TestResourceRetries(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers amqp.Table
+		retries int
+	}{
+		{"no headers", nil, 0},
+		{"int32", amqp.Table{ResourceRetryHeader: int32(2)}, 2},
+		{"int64", amqp.Table{ResourceRetryHeader: int64(4)}, 4},
+		{"int16", amqp.Table{ResourceRetryHeader: int16(5)}, 5},
+		{"not a number", amqp.Table{ResourceRetryHeader: "2"}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resourceRetries(amqp.Delivery{Headers: tt.headers}); got != tt.retries {
+				t.Errorf("resourceRetries() = %d, want %d", got, tt.retries)
+			}
+		})
+	}
+}
+
+func TestCopyHeaders(t *testing.T) {
+	headers := amqp.Table{AttemptHeader: int32(1)}
+	copied := copyHeaders(headers)
+	copied[AttemptHeader] = int32(2)
+	if headers[AttemptHeader] != int32(1) {
+		t.Error("copyHeaders() shares the table with the delivery")
+	}
+}
+
+func TestMessagePriority(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      amqp.Delivery
+		priority uint8
+	}{
+		{"property", amqp.Delivery{Priority: 7, Body: []byte(`{"priority":2}`)}, 7},
+		{"body", amqp.Delivery{Body: []byte(`{"job_id":"x","priority":6}`)}, 6},
+		{"neither", amqp.Delivery{Body: []byte(`{"job_id":"x"}`)}, 0},
+		{"invalid body", amqp.Delivery{Body: []byte(`not json`)}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := messagePriority(tt.msg); got != tt.priority {
+				t.Errorf("messagePriority() = %d, want %d", got, tt.priority)
+			}
+		})
+	}
+}
+
+func TestHighQueue(t *testing.T) {
+	queue := config.ConsumerQueue{
+		Queue:      "transcoding_queue",
+		RoutingKey: "video.transcoding.request",
+		Priority:   config.QueuePriority{HighRoutingKey: "video.transcoding.request.high", ReservedWorkers: 1},
+	}
+
+	high := highQueue(queue)
+	if high.Queue != "transcoding_queue.high" || high.RoutingKey != "video.transcoding.request.high" {
+		t.Errorf("highQueue() = %s bound to %s", high.Queue, high.RoutingKey)
+	}
+	if retryQueueName(high.Queue, time.Minute) == retryQueueName(queue.Queue, time.Minute) {
+		t.Error("high priority retries share the retry queue of the queue")
+	}
+}
+
+func TestNext(t *testing.T) {
+	high := make(chan delivery, 1)
+	jobs := make(chan delivery, 1)
+	jobs <- delivery{Delivery: amqp.Delivery{MessageId: "low"}}
+	high <- delivery{Delivery: amqp.Delivery{MessageId: "high"}}
+
+	for _, want := range []string{"high", "low"} {
+		if msg, ok := next(high, jobs); !ok || msg.MessageId != want {
+			t.Errorf("next() = %s, %v, want %s", msg.MessageId, ok, want)
+		}
+	}
+
+	close(high)
+	if _, ok := next(high, jobs); ok {
+		t.Error("next() took a job after the jobs were closed")
+	}
+}
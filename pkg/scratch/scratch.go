@@ -0,0 +1,196 @@
+package scratch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInsufficientSpace = errors.New("insufficient scratch space")
+	// ErrExceedsCapacity is returned for reservations that would not fit even
+	// on an empty volume.
+	ErrExceedsCapacity = errors.New("reservation exceeds scratch capacity")
+)
+
+// Space hands out per-job directories below a work directory and keeps track
+// of how much disk the running jobs expect to need, so concurrent jobs do not
+// fill the volume between them.
+type Space struct {
+	root    string
+	minFree uint64
+
+	mu           sync.Mutex
+	reservations map[string]uint64
+}
+
+func New(root string, minFree uint64) *Space {
+	return &Space{
+		root:         root,
+		minFree:      minFree,
+		reservations: make(map[string]uint64),
+	}
+}
+
+func (s *Space) Root() string {
+	return s.root
+}
+
+// JobDir returns the directory a job keeps its temporary files in.
+func (s *Space) JobDir(jobId string) string {
+	return filepath.Join(s.root, jobId)
+}
+
+// Reserve sets aside size bytes for a job. It fails with ErrInsufficientSpace
+// when the reservation would push free space below the configured minimum and
+// with ErrExceedsCapacity when it never could fit. The returned release must
+// be called once the job's files are gone.
+func (s *Space) Reserve(jobId string, size uint64) (func(), error) {
+	if err := os.MkdirAll(s.root, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	available, total, err := availableBytes(s.root)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return func() {}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if size+s.minFree > total {
+		return nil, fmt.Errorf("%w: job %s needs %d bytes of %d", ErrExceedsCapacity, jobId, size, total)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reserved := s.unusedReservations()
+	if available < reserved+size+s.minFree {
+		return nil, fmt.Errorf("%w: job %s needs %d bytes, %d available with %d reserved", ErrInsufficientSpace, jobId, size, available, reserved)
+	}
+
+	s.reservations[jobId] += size
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.reservations, jobId)
+	}, nil
+}
+
+// unusedReservations returns the part of the reservations that their jobs
+// have not written yet. What they wrote is already missing from the free
+// space and must not be subtracted twice.
+func (s *Space) unusedReservations() uint64 {
+	var unused uint64
+	for jobId, reserved := range s.reservations {
+		if used := dirSize(s.JobDir(jobId)); used < reserved {
+			unused += reserved - used
+		}
+	}
+
+	return unused
+}
+
+// dirSize returns the size of the regular files below dir.
+func dirSize(dir string) uint64 {
+	var size uint64
+	_ = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+
+	return size
+}
+
+// HasFreeSpace reports whether free space on the work directory is above the
+// configured minimum.
+func (s *Space) HasFreeSpace() (bool, error) {
+	available, _, err := availableBytes(s.root)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return available >= s.minFree, nil
+}
+
+// WaitForSpace blocks while free space is below the configured minimum,
+// checking again every interval.
+func (s *Space) WaitForSpace(ctx context.Context, interval time.Duration) error {
+	paused := false
+	for {
+		ok, err := s.HasFreeSpace()
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("work_dir", s.root).Msg("failed to check free space")
+			ok = true
+		}
+		if ok {
+			if paused {
+				zerolog.Ctx(ctx).Info().Str("work_dir", s.root).Msg("free space recovered, resuming consumption")
+			}
+			return nil
+		}
+
+		if !paused {
+			zerolog.Ctx(ctx).Warn().Str("work_dir", s.root).Uint64("min_free", s.minFree).Msg("free space below threshold, pausing consumption")
+			paused = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Sweep removes job directories left behind by a previous run. Files are
+// never touched. keep is asked about every directory and may veto the
+// removal, e.g. for directories that are not job directories or of jobs that
+// another worker sharing the work directory is still running.
+func (s *Space) Sweep(ctx context.Context, keep func(ctx context.Context, jobId string, modified time.Time) bool) error {
+	entries, err := os.ReadDir(s.root)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if keep(ctx, entry.Name(), info.ModTime()) {
+			continue
+		}
+
+		if err := os.RemoveAll(filepath.Join(s.root, entry.Name())); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("entry", entry.Name()).Msg("failed to remove orphaned scratch entry")
+			continue
+		}
+		removed++
+	}
+
+	zerolog.Ctx(ctx).Info().Str("work_dir", s.root).Int("removed", removed).Msg("swept orphaned scratch entries")
+
+	return nil
+}
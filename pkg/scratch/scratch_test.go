@@ -0,0 +1,90 @@
+package scratch
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSweep(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"orphaned", "running"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "notes.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	space := New(root, 0)
+	err := space.Sweep(context.Background(), func(ctx context.Context, name string, modified time.Time) bool {
+		return name == "running"
+	})
+	if err != nil {
+		t.Fatalf("Sweep() = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		exists bool
+	}{
+		{"orphaned", false},
+		{"running", true},
+		{"notes.txt", true},
+	}
+	for _, tt := range tests {
+		_, err := os.Stat(filepath.Join(root, tt.name))
+		if exists := err == nil; exists != tt.exists {
+			t.Errorf("%s exists = %v, want %v", tt.name, exists, tt.exists)
+		}
+	}
+}
+
+func TestUnusedReservations(t *testing.T) {
+	space := New(t.TempDir(), 0)
+	space.reservations["written"] = 100
+	space.reservations["overrun"] = 10
+	space.reservations["idle"] = 50
+
+	for jobId, size := range map[string]int{"written": 40, "overrun": 30} {
+		dir := space.JobDir(jobId)
+		if err := os.MkdirAll(filepath.Join(dir, "output"), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "output", "segment.ts"), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := space.unusedReservations(); got != 60+50 {
+		t.Errorf("unusedReservations() = %d, want %d", got, 60+50)
+	}
+}
+
+func TestReserveRelease(t *testing.T) {
+	space := New(t.TempDir(), 0)
+	release, err := space.Reserve("job", 1)
+	if err != nil {
+		t.Fatalf("Reserve() = %v", err)
+	}
+	release()
+
+	if len(space.reservations) != 0 {
+		t.Errorf("reservations after release = %v", space.reservations)
+	}
+}
+
+func TestReserveExceedsCapacity(t *testing.T) {
+	space := New(t.TempDir(), 0)
+	if _, _, err := availableBytes(space.Root()); errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("free space is not measured on this platform")
+	}
+
+	if _, err := space.Reserve("job", 1<<62); !errors.Is(err, ErrExceedsCapacity) {
+		t.Errorf("Reserve() = %v, want ErrExceedsCapacity", err)
+	}
+}
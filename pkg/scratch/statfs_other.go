@@ -0,0 +1,10 @@
+//go:build !unix
+
+package scratch
+
+import "errors"
+
+// availableBytes is not implemented outside unix, reservations always succeed.
+func availableBytes(path string) (uint64, uint64, error) {
+	return 0, 0, errors.ErrUnsupported
+}
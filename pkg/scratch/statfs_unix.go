@@ -0,0 +1,16 @@
+//go:build unix
+
+package scratch
+
+import "syscall"
+
+// availableBytes returns the free space available to the worker and the
+// total size of the file system at path.
+func availableBytes(path string) (uint64, uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+
+	return uint64(stat.Bavail) * uint64(stat.Bsize), uint64(stat.Blocks) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const localMetaDir = ".meta"
+
+// localStore keeps objects as plain files below root/<bucket>/<key> with a
+// JSON sidecar per object under root/.meta for content type and metadata.
+type localStore struct {
+	root    string
+	baseURL string
+}
+
+type localMeta struct {
+	ETag         string            `json:"etag"`
+	ContentType  string            `json:"content_type"`
+	CacheControl string            `json:"cache_control"`
+	UserMetadata map[string]string `json:"user_metadata"`
+}
+
+// bucketPath returns the directory of bucket. Bucket names come from
+// messages, so anything that is not a single directory below root is refused.
+func (l *localStore) bucketPath(bucket string) (string, error) {
+	switch bucket {
+	case "", ".", "..", localMetaDir:
+		return "", fmt.Errorf("invalid bucket %q", bucket)
+	}
+	if strings.ContainsAny(bucket, `/\`) || filepath.VolumeName(bucket) != "" {
+		return "", fmt.Errorf("invalid bucket %q", bucket)
+	}
+
+	p := filepath.Join(l.root, bucket)
+	rel, err := filepath.Rel(l.root, p)
+	if err != nil || rel != bucket {
+		return "", fmt.Errorf("invalid bucket %q", bucket)
+	}
+
+	return p, nil
+}
+
+func (l *localStore) objectPath(bucket, key string) (string, error) {
+	bucketDir, err := l.bucketPath(bucket)
+	if err != nil {
+		return "", err
+	}
+	clean := path.Clean("/" + key)
+	if clean == "/" {
+		return "", fmt.Errorf("invalid object %s/%s", bucket, key)
+	}
+
+	return filepath.Join(bucketDir, filepath.FromSlash(clean)), nil
+}
+
+func (l *localStore) metaPath(bucket, key string) string {
+	return filepath.Join(l.root, localMetaDir, bucket, filepath.FromSlash(path.Clean("/"+key))) + ".json"
+}
+
+func (l *localStore) Get(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	p, err := l.objectPath(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s/%s", ErrNotFound, bucket, key)
+	}
+
+	return file, err
+}
+
+func (l *localStore) Put(ctx context.Context, bucket, key string, reader io.Reader, size int64, opts PutOptions) error {
+	p, err := l.objectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+
+	// Write to a temp file first so readers never observe a partial object.
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hasher := md5.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hasher), reader)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return err
+	}
+
+	return l.writeMeta(bucket, key, localMeta{
+		ETag:         hex.EncodeToString(hasher.Sum(nil)),
+		ContentType:  opts.ContentType,
+		CacheControl: opts.CacheControl,
+		UserMetadata: opts.UserMetadata,
+	})
+}
+
+func (l *localStore) writeMeta(bucket, key string, meta localMeta) error {
+	metaPath := l.metaPath(bucket, key)
+	if err := os.MkdirAll(filepath.Dir(metaPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(metaPath, content, 0644)
+}
+
+func (l *localStore) readMeta(bucket, key string) localMeta {
+	var meta localMeta
+	content, err := os.ReadFile(l.metaPath(bucket, key))
+	if err == nil {
+		_ = json.Unmarshal(content, &meta)
+	}
+
+	return meta
+}
+
+func (l *localStore) Stat(ctx context.Context, bucket, key string) (ObjectInfo, error) {
+	p, err := l.objectPath(bucket, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	fileInfo, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && fileInfo.IsDir()) {
+		return ObjectInfo{}, fmt.Errorf("%w: %s/%s", ErrNotFound, bucket, key)
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	meta := l.readMeta(bucket, key)
+	return ObjectInfo{
+		Key:          key,
+		Size:         fileInfo.Size(),
+		ETag:         meta.ETag,
+		ContentType:  meta.ContentType,
+		LastModified: fileInfo.ModTime(),
+		UserMetadata: meta.UserMetadata,
+	}, nil
+}
+
+func (l *localStore) Remove(ctx context.Context, bucket, key string) error {
+	p, err := l.objectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(l.metaPath(bucket, key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func (l *localStore) List(ctx context.Context, bucket, prefix string) ([]ObjectInfo, error) {
+	bucketDir, err := l.bucketPath(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []ObjectInfo
+	err = filepath.WalkDir(bucketDir, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(bucketDir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := l.Stat(ctx, bucket, key)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, info)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
+
+func (l *localStore) Copy(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string, opts CopyOptions) error {
+	reader, err := l.Get(ctx, srcBucket, srcKey)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	meta := l.readMeta(srcBucket, srcKey)
+	return l.Put(ctx, dstBucket, dstKey, reader, -1, PutOptions{
+		ContentType:  meta.ContentType,
+		CacheControl: meta.CacheControl,
+		UserMetadata: meta.UserMetadata,
+	})
+}
+
+// Presign returns a plain URL below base_url. The local backend is meant to
+// sit behind a static file server, it cannot sign URLs.
+func (l *localStore) Presign(ctx context.Context, bucket, key string, expiry time.Duration) (string, error) {
+	if l.baseURL == "" {
+		return "", ErrNotSupported
+	}
+
+	return strings.TrimSuffix(l.baseURL, "/") + "/" + url.PathEscape(bucket) + "/" + (&url.URL{Path: key}).EscapedPath(), nil
+}
+
+func NewLocal(root, baseURL string) ObjectStore {
+	return &localStore{
+		root:    root,
+		baseURL: baseURL,
+	}
+}
@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryObject struct {
+	data         []byte
+	info         ObjectInfo
+	cacheControl string
+}
+
+// memoryStore is an in-process fake used by tests and throwaway local runs.
+type memoryStore struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+func memoryKey(bucket, key string) string {
+	return bucket + "/" + key
+}
+
+func (m *memoryStore) Get(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	object, ok := m.objects[memoryKey(bucket, key)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s/%s", ErrNotFound, bucket, key)
+	}
+
+	return io.NopCloser(bytes.NewReader(object.data)), nil
+}
+
+func (m *memoryStore) Put(ctx context.Context, bucket, key string, reader io.Reader, size int64, opts PutOptions) error {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	sum := md5.Sum(data)
+	metadata := make(map[string]string, len(opts.UserMetadata))
+	for k, v := range opts.UserMetadata {
+		metadata[k] = v
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.objects[memoryKey(bucket, key)] = memoryObject{
+		data: data,
+		info: ObjectInfo{
+			Key:          key,
+			Size:         int64(len(data)),
+			ETag:         hex.EncodeToString(sum[:]),
+			ContentType:  opts.ContentType,
+			LastModified: time.Now(),
+			UserMetadata: metadata,
+		},
+		cacheControl: opts.CacheControl,
+	}
+
+	return nil
+}
+
+func (m *memoryStore) Stat(ctx context.Context, bucket, key string) (ObjectInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	object, ok := m.objects[memoryKey(bucket, key)]
+	if !ok {
+		return ObjectInfo{}, fmt.Errorf("%w: %s/%s", ErrNotFound, bucket, key)
+	}
+
+	return object.info, nil
+}
+
+func (m *memoryStore) Remove(ctx context.Context, bucket, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.objects, memoryKey(bucket, key))
+	return nil
+}
+
+func (m *memoryStore) List(ctx context.Context, bucket, prefix string) ([]ObjectInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var objects []ObjectInfo
+	for k, object := range m.objects {
+		if strings.HasPrefix(k, memoryKey(bucket, prefix)) {
+			objects = append(objects, object.info)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	return objects, nil
+}
+
+func (m *memoryStore) Copy(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string, opts CopyOptions) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	object, ok := m.objects[memoryKey(srcBucket, srcKey)]
+	if !ok {
+		return fmt.Errorf("%w: %s/%s", ErrNotFound, srcBucket, srcKey)
+	}
+
+	object.info.Key = dstKey
+	object.info.LastModified = time.Now()
+	m.objects[memoryKey(dstBucket, dstKey)] = object
+	return nil
+}
+
+func (m *memoryStore) Presign(ctx context.Context, bucket, key string, expiry time.Duration) (string, error) {
+	return "", ErrNotSupported
+}
+
+func NewMemory() ObjectStore {
+	return &memoryStore{
+		objects: make(map[string]memoryObject),
+	}
+}
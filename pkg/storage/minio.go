@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type minioStore struct {
+	client *minio.Client
+	// sse is applied to every upload. SSE-C keys also have to be sent when
+	// reading, SSE-S3 and SSE-KMS are transparent to readers.
+	sse encrypt.ServerSide
+}
+
+// readSSE returns the encryption to send with reads and copies.
+func (m *minioStore) readSSE() encrypt.ServerSide {
+	if m.sse != nil && m.sse.Type() == encrypt.SSEC {
+		return m.sse
+	}
+
+	return nil
+}
+
+func (m *minioStore) Get(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	// GetObject is lazy, stat first so a missing object fails here and not on
+	// the first read.
+	if _, err := m.Stat(ctx, bucket, key); err != nil {
+		return nil, err
+	}
+
+	return m.client.GetObject(ctx, bucket, key, minio.GetObjectOptions{ServerSideEncryption: m.readSSE()})
+}
+
+func (m *minioStore) Put(ctx context.Context, bucket, key string, reader io.Reader, size int64, opts PutOptions) error {
+	_, err := m.client.PutObject(ctx, bucket, key, reader, size, minio.PutObjectOptions{
+		ContentType:          opts.ContentType,
+		CacheControl:         opts.CacheControl,
+		UserMetadata:         opts.UserMetadata,
+		PartSize:             opts.PartSize,
+		NumThreads:           opts.PartThreads,
+		StorageClass:         opts.StorageClass,
+		ServerSideEncryption: m.sse,
+	})
+	return err
+}
+
+func (m *minioStore) Stat(ctx context.Context, bucket, key string) (ObjectInfo, error) {
+	info, err := m.client.StatObject(ctx, bucket, key, minio.StatObjectOptions{ServerSideEncryption: m.readSSE()})
+	if err != nil {
+		return ObjectInfo{}, translateMinIOError(err)
+	}
+
+	return toObjectInfo(info), nil
+}
+
+func (m *minioStore) Remove(ctx context.Context, bucket, key string) error {
+	return m.client.RemoveObject(ctx, bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (m *minioStore) List(ctx context.Context, bucket, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	for object := range m.client.ListObjects(ctx, bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		objects = append(objects, toObjectInfo(object))
+	}
+
+	return objects, nil
+}
+
+func (m *minioStore) Copy(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string, opts CopyOptions) error {
+	dst := minio.CopyDestOptions{Bucket: dstBucket, Object: dstKey, Encryption: m.sse}
+	if opts.StorageClass != "" {
+		// The storage class can only be changed by replacing the metadata, so
+		// carry the source metadata over explicitly.
+		src, err := m.client.StatObject(ctx, srcBucket, srcKey, minio.StatObjectOptions{ServerSideEncryption: m.readSSE()})
+		if err != nil {
+			return translateMinIOError(err)
+		}
+
+		metadata := make(map[string]string, len(src.UserMetadata)+2)
+		for k, v := range src.UserMetadata {
+			metadata[k] = v
+		}
+		metadata["Content-Type"] = src.ContentType
+		metadata["X-Amz-Storage-Class"] = opts.StorageClass
+
+		dst.UserMetadata = metadata
+		dst.ReplaceMetadata = true
+	}
+
+	_, err := m.client.CopyObject(ctx, dst, minio.CopySrcOptions{Bucket: srcBucket, Object: srcKey, Encryption: m.readSSE()})
+	return translateMinIOError(err)
+}
+
+func (m *minioStore) Presign(ctx context.Context, bucket, key string, expiry time.Duration) (string, error) {
+	// A presigned URL can not carry the SSE-C key, readers would have to send
+	// it as headers.
+	if m.readSSE() != nil {
+		return "", fmt.Errorf("%w: presigned reads of SSE-C objects", ErrNotSupported)
+	}
+
+	u, err := m.client.PresignedGetObject(ctx, bucket, key, expiry, url.Values{})
+	if err != nil {
+		return "", err
+	}
+
+	return u.String(), nil
+}
+
+func toObjectInfo(info minio.ObjectInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:          info.Key,
+		Size:         info.Size,
+		ETag:         info.ETag,
+		ContentType:  info.ContentType,
+		LastModified: info.LastModified,
+		UserMetadata: info.UserMetadata,
+		Encryption:   objectEncryption(info.Metadata),
+	}
+}
+
+func objectEncryption(header http.Header) string {
+	if header.Get(encrypt.SseCustomerAlgorithm) != "" {
+		return EncryptionSSEC
+	}
+
+	return header.Get(encrypt.SseGenericHeader)
+}
+
+func translateMinIOError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchBucket":
+		return fmt.Errorf("%w: %s", ErrNotFound, err.Error())
+	}
+
+	return err
+}
+
+// NewMinIO wraps a MinIO/S3 client. sse may be nil.
+func NewMinIO(client *minio.Client, sse encrypt.ServerSide) ObjectStore {
+	return &minioStore{
+		client: client,
+		sse:    sse,
+	}
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var ErrUnknownProfile = errors.New("unknown storage profile")
+
+// Target is a bucket on a named storage profile.
+type Target struct {
+	Profile string
+	Store   ObjectStore
+	Bucket  string
+}
+
+// Registry maps profile names to stores and their default buckets.
+type Registry struct {
+	defaultProfile string
+	targets        map[string]Target
+}
+
+func NewRegistry(defaultProfile string) *Registry {
+	return &Registry{
+		defaultProfile: defaultProfile,
+		targets:        make(map[string]Target),
+	}
+}
+
+func (r *Registry) Register(profile string, store ObjectStore, bucket string) {
+	r.targets[profile] = Target{Profile: profile, Store: store, Bucket: bucket}
+}
+
+// Resolve returns the target for profile and bucket. An empty profile means
+// the default profile and an empty bucket the profile's default bucket.
+func (r *Registry) Resolve(profile, bucket string) (Target, error) {
+	if profile == "" {
+		profile = r.defaultProfile
+	}
+
+	target, ok := r.targets[profile]
+	if !ok {
+		return Target{}, fmt.Errorf("%w %q", ErrUnknownProfile, profile)
+	}
+	if bucket != "" {
+		target.Bucket = bucket
+	}
+	if target.Bucket == "" {
+		return Target{}, fmt.Errorf("no bucket given and profile %q has no default bucket", profile)
+	}
+
+	return target, nil
+}
+
+func (r *Registry) Profiles() []string {
+	profiles := make([]string, 0, len(r.targets))
+	for profile := range r.targets {
+		profiles = append(profiles, profile)
+	}
+	sort.Strings(profiles)
+
+	return profiles
+}
+
+// CopyObject copies an object between targets. Within one store the copy is
+// done server-side, across stores the object is streamed through the worker.
+func CopyObject(ctx context.Context, src Target, srcKey string, dst Target, dstKey string, opts CopyOptions) error {
+	if src.Store == dst.Store {
+		return src.Store.Copy(ctx, src.Bucket, srcKey, dst.Bucket, dstKey, opts)
+	}
+
+	info, err := src.Store.Stat(ctx, src.Bucket, srcKey)
+	if err != nil {
+		return err
+	}
+
+	reader, err := src.Store.Get(ctx, src.Bucket, srcKey)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return dst.Store.Put(ctx, dst.Bucket, dstKey, reader, info.Size, PutOptions{
+		ContentType:  info.ContentType,
+		UserMetadata: info.UserMetadata,
+		StorageClass: opts.StorageClass,
+	})
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound     = errors.New("object not found")
+	ErrNotSupported = errors.New("operation not supported by storage backend")
+)
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	ContentType  string
+	LastModified time.Time
+	UserMetadata map[string]string
+	// Encryption is the server-side encryption of the object as reported by
+	// the backend (AES256, aws:kms or SSE-C), empty when unencrypted.
+	Encryption string
+}
+
+const EncryptionSSEC = "SSE-C"
+
+// ETagIsMD5 reports whether the ETag can be compared against the MD5 of the
+// content. Multipart uploads, SSE-KMS and SSE-C produce opaque ETags.
+func (info ObjectInfo) ETagIsMD5() bool {
+	if info.Encryption != "" && info.Encryption != "AES256" {
+		return false
+	}
+
+	etag := strings.Trim(info.ETag, `"`)
+	if len(etag) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(etag)
+	return err == nil
+}
+
+type PutOptions struct {
+	ContentType  string
+	CacheControl string
+	UserMetadata map[string]string
+	// PartSize and PartThreads tune multipart uploads on backends that use
+	// them. Zero keeps the backend default.
+	PartSize    uint64
+	PartThreads uint
+	// StorageClass is a hint such as STANDARD_IA or GLACIER, backends without
+	// storage classes ignore it.
+	StorageClass string
+}
+
+type CopyOptions struct {
+	StorageClass string
+}
+
+// ObjectStore is the subset of S3 semantics the worker relies on. Keys always
+// use forward slashes regardless of the host OS.
+type ObjectStore interface {
+	Get(ctx context.Context, bucket, key string) (io.ReadCloser, error)
+	Put(ctx context.Context, bucket, key string, reader io.Reader, size int64, opts PutOptions) error
+	Stat(ctx context.Context, bucket, key string) (ObjectInfo, error)
+	Remove(ctx context.Context, bucket, key string) error
+	List(ctx context.Context, bucket, prefix string) ([]ObjectInfo, error)
+	Copy(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string, opts CopyOptions) error
+	Presign(ctx context.Context, bucket, key string, expiry time.Duration) (string, error)
+}
+
+// FGet downloads an object into a local file.
+func FGet(ctx context.Context, store ObjectStore, bucket, key, localPath string) error {
+	reader, err := store.Get(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	file, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, reader)
+	return err
+}
+
+// FPut uploads a local file as an object.
+func FPut(ctx context.Context, store ObjectStore, bucket, key, localPath string, opts PutOptions) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	return store.Put(ctx, bucket, key, file, info.Size(), opts)
+}
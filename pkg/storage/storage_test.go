@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func backends(t *testing.T) map[string]ObjectStore {
+	return map[string]ObjectStore{
+		"memory": NewMemory(),
+		"local":  NewLocal(t.TempDir(), ""),
+	}
+}
+
+func put(t *testing.T, store ObjectStore, bucket, key, content string) {
+	t.Helper()
+	err := store.Put(context.Background(), bucket, key, strings.NewReader(content), int64(len(content)), PutOptions{
+		ContentType:  "text/plain",
+		UserMetadata: map[string]string{"sha256": "abc"},
+	})
+	if err != nil {
+		t.Fatalf("Put(%s/%s) = %v", bucket, key, err)
+	}
+}
+
+func read(t *testing.T, store ObjectStore, bucket, key string) string {
+	t.Helper()
+	reader, err := store.Get(context.Background(), bucket, key)
+	if err != nil {
+		t.Fatalf("Get(%s/%s) = %v", bucket, key, err)
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("read %s/%s: %v", bucket, key, err)
+	}
+	return string(content)
+}
+
+func TestObjectStore(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			put(t, store, "content", "lessons/1/video.mp4", "video")
+			put(t, store, "content", "lessons/1/hls/master.m3u8", "#EXTM3U")
+			put(t, store, "content", "lessons/2/video.mp4", "other")
+
+			if got := read(t, store, "content", "lessons/1/video.mp4"); got != "video" {
+				t.Errorf("Get() = %q, want %q", got, "video")
+			}
+
+			info, err := store.Stat(ctx, "content", "lessons/1/video.mp4")
+			if err != nil {
+				t.Fatalf("Stat() = %v", err)
+			}
+			if info.Size != 5 || info.ContentType != "text/plain" || info.UserMetadata["sha256"] != "abc" {
+				t.Errorf("Stat() = %+v", info)
+			}
+			if !info.ETagIsMD5() {
+				t.Errorf("ETag %q is not an MD5", info.ETag)
+			}
+
+			objects, err := store.List(ctx, "content", "lessons/1/")
+			if err != nil {
+				t.Fatalf("List() = %v", err)
+			}
+			var keys []string
+			for _, object := range objects {
+				keys = append(keys, object.Key)
+			}
+			if got := strings.Join(keys, ","); got != "lessons/1/hls/master.m3u8,lessons/1/video.mp4" {
+				t.Errorf("List() = %s", got)
+			}
+
+			if err := store.Copy(ctx, "content", "lessons/1/video.mp4", "archive", "1/video.mp4", CopyOptions{}); err != nil {
+				t.Fatalf("Copy() = %v", err)
+			}
+			if got := read(t, store, "archive", "1/video.mp4"); got != "video" {
+				t.Errorf("Get() of copy = %q, want %q", got, "video")
+			}
+
+			if err := store.Remove(ctx, "content", "lessons/1/video.mp4"); err != nil {
+				t.Fatalf("Remove() = %v", err)
+			}
+			if err := store.Remove(ctx, "content", "lessons/1/video.mp4"); err != nil {
+				t.Errorf("Remove() of a missing object = %v", err)
+			}
+			if _, err := store.Stat(ctx, "content", "lessons/1/video.mp4"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Stat() of a removed object = %v, want ErrNotFound", err)
+			}
+			if _, err := store.Get(ctx, "content", "missing"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get() of a missing object = %v, want ErrNotFound", err)
+			}
+			if err := store.Copy(ctx, "content", "missing", "archive", "missing", CopyOptions{}); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Copy() of a missing object = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestLocalBucketNames(t *testing.T) {
+	ctx := context.Background()
+	store := NewLocal(t.TempDir(), "")
+	tests := []struct {
+		bucket string
+		valid  bool
+	}{
+		{"content", true},
+		{"my.bucket", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{".meta", false},
+		{"../outside", false},
+		{"a/b", false},
+		{`a\b`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.bucket, func(t *testing.T) {
+			err := store.Put(ctx, tt.bucket, "key", strings.NewReader("x"), 1, PutOptions{})
+			if (err == nil) != tt.valid {
+				t.Errorf("Put() = %v, want valid %v", err, tt.valid)
+			}
+			_, err = store.List(ctx, tt.bucket, "")
+			if (err == nil) != tt.valid {
+				t.Errorf("List() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestLocalKeysStayInBucket(t *testing.T) {
+	store := NewLocal(t.TempDir(), "")
+	put(t, store, "content", "../../escape.txt", "x")
+
+	if got := read(t, store, "content", "escape.txt"); got != "x" {
+		t.Errorf("Get() = %q, want the key cleaned into the bucket", got)
+	}
+	if _, err := store.Stat(context.Background(), "content", "/"); err == nil {
+		t.Error("Stat() of the bucket root succeeded")
+	}
+}
+
+func TestPresign(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name  string
+		store ObjectStore
+		url   string
+		err   error
+	}{
+		{"memory", NewMemory(), "", ErrNotSupported},
+		{"local without base url", NewLocal(t.TempDir(), ""), "", ErrNotSupported},
+		{"local", NewLocal(t.TempDir(), "https://files.example.com/"), "https://files.example.com/content/lessons/a%20b.mp4", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, err := tt.store.Presign(ctx, "content", "lessons/a b.mp4", 0)
+			if !errors.Is(err, tt.err) || url != tt.url {
+				t.Errorf("Presign() = %q, %v, want %q, %v", url, err, tt.url, tt.err)
+			}
+		})
+	}
+}
+
+func TestETagIsMD5(t *testing.T) {
+	tests := []struct {
+		name string
+		info ObjectInfo
+		md5  bool
+	}{
+		{"plain", ObjectInfo{ETag: `"9e107d9d372bb6826bd81d3542a419d6"`}, true},
+		{"multipart", ObjectInfo{ETag: "9e107d9d372bb6826bd81d3542a419d6-3"}, false},
+		{"sse-s3", ObjectInfo{ETag: "9e107d9d372bb6826bd81d3542a419d6", Encryption: "AES256"}, true},
+		{"sse-kms", ObjectInfo{ETag: "9e107d9d372bb6826bd81d3542a419d6", Encryption: "aws:kms"}, false},
+		{"sse-c", ObjectInfo{ETag: "9e107d9d372bb6826bd81d3542a419d6", Encryption: EncryptionSSEC}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.info.ETagIsMD5(); got != tt.md5 {
+				t.Errorf("ETagIsMD5() = %v, want %v", got, tt.md5)
+			}
+		})
+	}
+}
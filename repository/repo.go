@@ -3,10 +3,13 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"github.com/google/uuid"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
+	"time"
 	"worker-transcode/constant"
 	"worker-transcode/entities"
 )
@@ -15,12 +18,34 @@ type JobRepository interface {
 	Transaction(ctx context.Context, callback func(ctx context.Context) error, opts ...*sql.TxOptions) error
 	GetDB() *gorm.DB
 	FindJobById(ctx context.Context, id uuid.UUID) (*entities.Job, error)
-	UpdateStatusJob(context context.Context, status constant.JobStatus, id uuid.UUID) error
+	UpdateStatusJob(ctx context.Context, status constant.JobStatus, id uuid.UUID) error
+	TouchJob(ctx context.Context, id uuid.UUID) error
 	UpdateLessonVideoURL(ctx context.Context, lessonId uuid.UUID, url string) error
+	FindLessonById(ctx context.Context, id uuid.UUID) (*entities.Lesson, error)
 	GetRecordingsByLessonId(ctx context.Context, lessonId uuid.UUID) ([]*entities.Recording, error)
 	GetRecordingChunksByLiveSessionId(ctx context.Context, liveSessionId uuid.UUID) ([]*entities.RecordingChunk, error)
 	UpdateRecordingChunkStatus(ctx context.Context, chunkId uuid.UUID, status string) error
 	UpdateLiveSessionRecording(ctx context.Context, liveSessionId uuid.UUID, recordingStatus string, finalVideoObjectName string, recordingDuration int, totalChunks int) error
+	FindSourceHash(ctx context.Context, hash string, ladderProfile string) (*entities.SourceHash, error)
+	SaveSourceHash(ctx context.Context, sourceHash *entities.SourceHash) error
+	DeleteSourceHashes(ctx context.Context, jobId uuid.UUID) error
+	GetJobCheckpoints(ctx context.Context, jobId uuid.UUID) ([]*entities.JobCheckpoint, error)
+	SaveJobCheckpoint(ctx context.Context, checkpoint *entities.JobCheckpoint) error
+	DeleteJobCheckpoints(ctx context.Context, jobId uuid.UUID) error
+	FindLessonSource(ctx context.Context, lessonId uuid.UUID) (*entities.LessonSource, error)
+	SaveLessonSource(ctx context.Context, source *entities.LessonSource) error
+	DeleteLessonSource(ctx context.Context, lessonId uuid.UUID) error
+	SaveJobResult(ctx context.Context, result *entities.JobResult) error
+	FindJobResult(ctx context.Context, jobId uuid.UUID) (*entities.JobResult, error)
+	CreateJob(ctx context.Context, job *entities.Job) error
+	ClaimObject(ctx context.Context, claim *entities.ObjectJob) (*entities.ObjectJob, error)
+	FindLatestObjectClaim(ctx context.Context, profile, bucket, key string) (*entities.ObjectJob, error)
+	SaveOutboxEvent(ctx context.Context, event *entities.OutboxEvent) error
+	ClaimPendingOutboxEvents(ctx context.Context, limit int) ([]*entities.OutboxEvent, error)
+	MarkOutboxEventSent(ctx context.Context, id uuid.UUID) error
+	MarkOutboxEventFailed(ctx context.Context, id uuid.UUID, reason string) error
+	DeleteSentOutboxEvents(ctx context.Context, before time.Time) error
+	Migrate(ctx context.Context) error
 }
 
 type repo struct {
@@ -29,7 +54,7 @@ type repo struct {
 
 func (r *repo) UpdateLessonVideoURL(ctx context.Context, lessonId uuid.UUID, url string) error {
 	lesson := &entities.Lesson{}
-	err := r.GetDB().Model(lesson).Where("id = ?", lessonId).Update("video_url", url).Error
+	err := r.conn(ctx).Model(lesson).Where("id = ?", lessonId).Update("video_url", url).Error
 	if err != nil {
 		return err
 	}
@@ -37,9 +62,19 @@ func (r *repo) UpdateLessonVideoURL(ctx context.Context, lessonId uuid.UUID, url
 	return nil
 }
 
+func (r *repo) FindLessonById(ctx context.Context, id uuid.UUID) (*entities.Lesson, error) {
+	lesson := &entities.Lesson{}
+	err := r.conn(ctx).First(lesson, "id = ?", id).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return lesson, nil
+}
+
 func (r *repo) FindJobById(ctx context.Context, id uuid.UUID) (*entities.Job, error) {
 	job := &entities.Job{}
-	err := r.GetDB().First(job, "id = ?", id).Error
+	err := r.conn(ctx).First(job, "id = ?", id).Error
 	if err != nil {
 		return nil, err
 	}
@@ -47,20 +82,26 @@ func (r *repo) FindJobById(ctx context.Context, id uuid.UUID) (*entities.Job, er
 	return job, nil
 }
 
-func (r *repo) UpdateStatusJob(context context.Context, status constant.JobStatus, id uuid.UUID) error {
+func (r *repo) UpdateStatusJob(ctx context.Context, status constant.JobStatus, id uuid.UUID) error {
 	job := &entities.Job{}
-	err := r.GetDB().First(job, "id = ?", id).Error
+	err := r.conn(ctx).First(job, "id = ?", id).Error
 	if err != nil {
 		return err
 	}
 	job.Status = status
-	err = r.GetDB().Save(job).Error
+	err = r.conn(ctx).Save(job).Error
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// TouchJob sets updated_at of the job to now, which tells other workers the
+// job is still running.
+func (r *repo) TouchJob(ctx context.Context, id uuid.UUID) error {
+	return r.conn(ctx).Model(&entities.Job{}).Where("id = ?", id).Update("updated_at", time.Now()).Error
+}
+
 func NewRepo(db *sql.DB) JobRepository {
 	gormDB, _ := gorm.Open(postgres.New(postgres.Config{
 		Conn: db}),
@@ -77,9 +118,13 @@ func (r *repo) GetDB() *gorm.DB {
 	return r.db
 }
 
+type txKey struct{}
+
+// Transaction runs callback in a transaction. Repository calls made with the
+// ctx passed to callback take part in it, nested calls use savepoints.
 func (r *repo) Transaction(ctx context.Context, callback func(ctx context.Context) error, opts ...*sql.TxOptions) error {
-	return r.GetDB().Transaction(func(tx *gorm.DB) error {
-		err := callback(ctx)
+	return r.conn(ctx).Transaction(func(tx *gorm.DB) error {
+		err := callback(context.WithValue(ctx, txKey{}, tx))
 		if err != nil {
 			return err
 		}
@@ -87,9 +132,17 @@ func (r *repo) Transaction(ctx context.Context, callback func(ctx context.Contex
 	}, opts...)
 }
 
+// conn returns the transaction carried by ctx, or the pool outside of one.
+func (r *repo) conn(ctx context.Context) *gorm.DB {
+	if tx, ok := ctx.Value(txKey{}).(*gorm.DB); ok {
+		return tx
+	}
+	return r.GetDB()
+}
+
 func (r *repo) GetRecordingsByLessonId(ctx context.Context, lessonId uuid.UUID) ([]*entities.Recording, error) {
 	var recordings []*entities.Recording
-	err := r.GetDB().Where("lesson_id = ?", lessonId).Order("chunk_number ASC").Find(&recordings).Error
+	err := r.conn(ctx).Where("lesson_id = ?", lessonId).Order("chunk_number ASC").Find(&recordings).Error
 	if err != nil {
 		return nil, err
 	}
@@ -98,7 +151,7 @@ func (r *repo) GetRecordingsByLessonId(ctx context.Context, lessonId uuid.UUID)
 
 func (r *repo) GetRecordingChunksByLiveSessionId(ctx context.Context, liveSessionId uuid.UUID) ([]*entities.RecordingChunk, error) {
 	var chunks []*entities.RecordingChunk
-	err := r.GetDB().Where("live_session_id = ?", liveSessionId).Order("chunk_index ASC").Find(&chunks).Error
+	err := r.conn(ctx).Where("live_session_id = ?", liveSessionId).Order("chunk_index ASC").Find(&chunks).Error
 	if err != nil {
 		return nil, err
 	}
@@ -107,7 +160,7 @@ func (r *repo) GetRecordingChunksByLiveSessionId(ctx context.Context, liveSessio
 
 func (r *repo) UpdateRecordingChunkStatus(ctx context.Context, chunkId uuid.UUID, status string) error {
 	chunk := &entities.RecordingChunk{}
-	err := r.GetDB().Model(chunk).Where("id = ?", chunkId).Update("status", status).Error
+	err := r.conn(ctx).Model(chunk).Where("id = ?", chunkId).Update("status", status).Error
 	if err != nil {
 		return err
 	}
@@ -122,9 +175,174 @@ func (r *repo) UpdateLiveSessionRecording(ctx context.Context, liveSessionId uui
 		"recording_duration":      recordingDuration,
 		"total_chunks":            totalChunks,
 	}
-	err := r.GetDB().Model(liveSession).Where("id = ?", liveSessionId).Updates(updates).Error
+	err := r.conn(ctx).Model(liveSession).Where("id = ?", liveSessionId).Updates(updates).Error
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// FindSourceHash returns nil without an error when no completed output exists
+// for the hash and ladder profile.
+func (r *repo) FindSourceHash(ctx context.Context, hash string, ladderProfile string) (*entities.SourceHash, error) {
+	sourceHash := &entities.SourceHash{}
+	err := r.conn(ctx).First(sourceHash, "hash = ? AND ladder_profile = ?", hash, ladderProfile).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sourceHash, nil
+}
+
+func (r *repo) SaveSourceHash(ctx context.Context, sourceHash *entities.SourceHash) error {
+	return r.conn(ctx).Save(sourceHash).Error
+}
+
+func (r *repo) DeleteSourceHashes(ctx context.Context, jobId uuid.UUID) error {
+	return r.conn(ctx).Where("job_id = ?", jobId).Delete(&entities.SourceHash{}).Error
+}
+
+func (r *repo) GetJobCheckpoints(ctx context.Context, jobId uuid.UUID) ([]*entities.JobCheckpoint, error) {
+	var checkpoints []*entities.JobCheckpoint
+	err := r.conn(ctx).Where("job_id = ?", jobId).Order("created_at ASC").Find(&checkpoints).Error
+	if err != nil {
+		return nil, err
+	}
+	return checkpoints, nil
+}
+
+func (r *repo) SaveJobCheckpoint(ctx context.Context, checkpoint *entities.JobCheckpoint) error {
+	return r.conn(ctx).Save(checkpoint).Error
+}
+
+func (r *repo) DeleteJobCheckpoints(ctx context.Context, jobId uuid.UUID) error {
+	return r.conn(ctx).Where("job_id = ?", jobId).Delete(&entities.JobCheckpoint{}).Error
+}
+
+// FindLessonSource returns nil without an error when no source is retained
+// for the lesson.
+func (r *repo) FindLessonSource(ctx context.Context, lessonId uuid.UUID) (*entities.LessonSource, error) {
+	source := &entities.LessonSource{}
+	err := r.conn(ctx).First(source, "lesson_id = ?", lessonId).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+func (r *repo) SaveLessonSource(ctx context.Context, source *entities.LessonSource) error {
+	return r.conn(ctx).Save(source).Error
+}
+
+func (r *repo) DeleteLessonSource(ctx context.Context, lessonId uuid.UUID) error {
+	return r.conn(ctx).Where("lesson_id = ?", lessonId).Delete(&entities.LessonSource{}).Error
+}
+
+func (r *repo) SaveJobResult(ctx context.Context, result *entities.JobResult) error {
+	return r.conn(ctx).Save(result).Error
+}
+
+// FindJobResult returns nil without an error when the job has no result.
+func (r *repo) FindJobResult(ctx context.Context, jobId uuid.UUID) (*entities.JobResult, error) {
+	result := &entities.JobResult{}
+	err := r.conn(ctx).First(result, "job_id = ?", jobId).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *repo) CreateJob(ctx context.Context, job *entities.Job) error {
+	return r.conn(ctx).Create(job).Error
+}
+
+// ClaimObject stores the claim unless the object version is already claimed
+// and returns the claim that is in place, which names the owning job.
+func (r *repo) ClaimObject(ctx context.Context, claim *entities.ObjectJob) (*entities.ObjectJob, error) {
+	err := r.conn(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(claim).Error
+	if err != nil {
+		return nil, err
+	}
+
+	existing := &entities.ObjectJob{}
+	err = r.conn(ctx).First(existing, "profile = ? AND bucket = ? AND object_key = ? AND etag = ?",
+		claim.Profile, claim.Bucket, claim.ObjectKey, claim.ETag).Error
+	if err != nil {
+		return nil, err
+	}
+	return existing, nil
+}
+
+// FindLatestObjectClaim returns the newest claim on any version of the object,
+// or nil without an error when it was never claimed.
+func (r *repo) FindLatestObjectClaim(ctx context.Context, profile, bucket, key string) (*entities.ObjectJob, error) {
+	claim := &entities.ObjectJob{}
+	err := r.conn(ctx).Order("created_at DESC").
+		First(claim, "profile = ? AND bucket = ? AND object_key = ?", profile, bucket, key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return claim, nil
+}
+
+func (r *repo) SaveOutboxEvent(ctx context.Context, event *entities.OutboxEvent) error {
+	return r.conn(ctx).Create(event).Error
+}
+
+// ClaimPendingOutboxEvents locks the oldest unsent events. It has to run in a
+// transaction, other relays skip the locked rows until it ends.
+func (r *repo) ClaimPendingOutboxEvents(ctx context.Context, limit int) ([]*entities.OutboxEvent, error) {
+	var events []*entities.OutboxEvent
+	err := r.conn(ctx).
+		Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+		Where("sent_at IS NULL").
+		Order("created_at ASC").
+		Limit(limit).
+		Find(&events).Error
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (r *repo) MarkOutboxEventSent(ctx context.Context, id uuid.UUID) error {
+	return r.conn(ctx).Model(&entities.OutboxEvent{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"sent_at":  time.Now(),
+		"attempts": gorm.Expr("attempts + 1"),
+	}).Error
+}
+
+func (r *repo) MarkOutboxEventFailed(ctx context.Context, id uuid.UUID, reason string) error {
+	return r.conn(ctx).Model(&entities.OutboxEvent{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"last_error": reason,
+		"attempts":   gorm.Expr("attempts + 1"),
+	}).Error
+}
+
+func (r *repo) DeleteSentOutboxEvents(ctx context.Context, before time.Time) error {
+	return r.conn(ctx).Where("sent_at < ?", before).Delete(&entities.OutboxEvent{}).Error
+}
+
+// Migrate creates the tables owned by the worker. Tables shared with the LMS
+// (jobs, lessons, live_sessions, ...) are managed by the LMS itself.
+func (r *repo) Migrate(ctx context.Context) error {
+	return r.GetDB().AutoMigrate(
+		&entities.SourceHash{},
+		&entities.JobCheckpoint{},
+		&entities.LessonSource{},
+		&entities.JobResult{},
+		&entities.ObjectJob{},
+		&entities.OutboxEvent{},
+	)
+}
@@ -28,40 +28,59 @@ func RunHttp(cfg *config.Config) {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	conn, err := config.NewRabbitMQConn(ctx, cfg.Queue)
-	if err != nil {
-		zerolog.Ctx(ctx).Error().Err(err).Msg("NewRabbitMQConn")
-	}
+	conn := rabbitmq.NewConnection(cfg.Queue)
+	go conn.Run(ctx)
 
 	repo := repository.NewRepo(cfg.DB)
+	if err := repo.Migrate(ctx); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to migrate worker tables")
+	}
+	if err := service.SweepScratch(ctx, repo, cfg); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to sweep scratch space")
+	}
+	waitForSpace := func(ctx context.Context) error {
+		return cfg.Scratch.WaitForSpace(ctx, cfg.WorkDir.PauseInterval)
+	}
+
+	if cfg.Events.Enabled {
+		publisher := rabbitmq.NewPublisher(conn, cfg.Events.Exchange, cfg.Events.ExchangeKind)
+		go service.RunOutboxRelay(ctx, repo, publisher, cfg)
+	}
+
 	transcodeService := service.NewService(repo, cfg)
 	recordingMergeService := service.NewRecordingMergeService(repo, cfg)
 
+	notificationService, err := service.NewNotificationService(repo, cfg, transcodeService)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("invalid notification rules")
+	}
+
 	serviceDeps := jobHandler.ServiceDependencies{
 		TranscodeService:      transcodeService,
 		RecordingMergeService: recordingMergeService,
+		NotificationService:   notificationService,
 	}
 
-	// Start transcoding consumer
-	transcodeConsumer := rabbitmq.NewConsumer(conn, cfg.Queue, cfg.Server.Workers, jobHandler.JobHandler)
-	go func() {
-		err := transcodeConsumer.Consume(ctx, serviceDeps)
-		if err != nil {
-			zerolog.Ctx(ctx).Error().Err(err).Msg("Transcode consumer error")
+	var consumers []rabbitmq.Consumer[jobHandler.ServiceDependencies]
+	for _, queue := range cfg.Queue.Consumers {
+		handler, ok := jobHandler.Handlers[queue.Handler]
+		if !ok {
+			zerolog.Ctx(ctx).Error().Str("handler", queue.Handler).Str("queue", queue.Queue).Msg("unknown consumer handler")
+			continue
 		}
-	}()
 
-	// Start recording merge consumer
-	recordingConsumer := rabbitmq.NewRecordingConsumer(conn, cfg.Queue, cfg.Server.Workers, jobHandler.RecordingMergeHandler)
-	go func() {
-		err := recordingConsumer.Consume(ctx, serviceDeps)
-		if err != nil {
-			zerolog.Ctx(ctx).Error().Err(err).Msg("Recording merge consumer error")
-		}
-	}()
+		consumer := rabbitmq.NewConsumer(conn, cfg.Queue, queue, waitForSpace, handler)
+		consumers = append(consumers, consumer)
+		go func() {
+			err := consumer.Consume(ctx, serviceDeps)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				zerolog.Ctx(ctx).Error().Err(err).Str("queue", queue.Queue).Msg("consumer error")
+			}
+		}()
+	}
 
 	r := gin.Default()
-	addHealth(r)
+	addHealth(r, conn, consumers)
 
 	handler := http.Server{
 		Handler:           r,
@@ -85,10 +104,34 @@ func RunHttp(cfg *config.Config) {
 	zerolog.Ctx(ctx).Info().Str("env", cfg.App.Environment).Msg("server shutdown")
 }
 
-func addHealth(r *gin.Engine) {
+// addHealth reports unavailable while the broker connection is down or any
+// consumer is not subscribed to its queue.
+func addHealth(r *gin.Engine, conn *rabbitmq.Connection, consumers []rabbitmq.Consumer[jobHandler.ServiceDependencies]) {
 	r.GET("/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{
-			"status": "ok",
+		healthy := conn.Connected()
+		rabbitmqState := "connected"
+		if !healthy {
+			rabbitmqState = "disconnected"
+		}
+
+		queues := gin.H{}
+		for _, consumer := range consumers {
+			state := "consuming"
+			if !consumer.Consuming() {
+				state = "stopped"
+				healthy = false
+			}
+			queues[consumer.Queue()] = state
+		}
+
+		status, code := "ok", http.StatusOK
+		if !healthy {
+			status, code = "unavailable", http.StatusServiceUnavailable
+		}
+		c.JSON(code, gin.H{
+			"status":    status,
+			"rabbitmq":  rabbitmqState,
+			"consumers": queues,
 		})
 	})
 }
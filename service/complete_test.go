@@ -0,0 +1,184 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"path"
+	"testing"
+	"worker-transcode/config"
+	"worker-transcode/constant"
+	"worker-transcode/dto"
+	"worker-transcode/entities"
+	"worker-transcode/pkg/storage"
+)
+
+// lessonJobs keeps what completing a job writes in memory, on top of the
+// retained sources.
+type lessonJobs struct {
+	*lessonSources
+	lesson   *entities.Lesson
+	status   map[uuid.UUID]constant.JobStatus
+	results  map[uuid.UUID]*entities.JobResult
+	unhashed []uuid.UUID
+}
+
+func newLessonJobs(lesson *entities.Lesson) *lessonJobs {
+	return &lessonJobs{
+		lessonSources: &lessonSources{sources: make(map[uuid.UUID]*entities.LessonSource)},
+		lesson:        lesson,
+		status:        make(map[uuid.UUID]constant.JobStatus),
+		results:       make(map[uuid.UUID]*entities.JobResult),
+	}
+}
+
+func (r *lessonJobs) Transaction(ctx context.Context, callback func(ctx context.Context) error, _ ...*sql.TxOptions) error {
+	return callback(ctx)
+}
+
+func (r *lessonJobs) FindLessonById(_ context.Context, id uuid.UUID) (*entities.Lesson, error) {
+	if r.lesson == nil || r.lesson.Id != id {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return r.lesson, nil
+}
+
+func (r *lessonJobs) UpdateLessonVideoURL(_ context.Context, _ uuid.UUID, url string) error {
+	r.lesson.VideoUrl = url
+	return nil
+}
+
+func (r *lessonJobs) UpdateStatusJob(_ context.Context, status constant.JobStatus, id uuid.UUID) error {
+	r.status[id] = status
+	return nil
+}
+
+func (r *lessonJobs) SaveJobResult(_ context.Context, result *entities.JobResult) error {
+	r.results[result.JobId] = result
+	return nil
+}
+
+func (r *lessonJobs) FindJobResult(_ context.Context, jobId uuid.UUID) (*entities.JobResult, error) {
+	return r.results[jobId], nil
+}
+
+func (r *lessonJobs) DeleteJobCheckpoints(context.Context, uuid.UUID) error {
+	return nil
+}
+
+func (r *lessonJobs) DeleteSourceHashes(_ context.Context, jobId uuid.UUID) error {
+	r.unhashed = append(r.unhashed, jobId)
+	return nil
+}
+
+// uploadOutput uploads an HLS output with its manifest below prefix like a
+// finished job does. files replaces its objects, an empty one leaves it out.
+func uploadOutput(t *testing.T, store storage.ObjectStore, prefix string, files map[string]string) {
+	t.Helper()
+	ctx := context.Background()
+	output := map[string]string{
+		"master.m3u8": "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=3192000\n720p.m3u8\n",
+		"720p.m3u8":   "#EXTM3U\n#EXTINF:6.0,\n720p_000.ts\n#EXTINF:6.0,\n720p_001.ts\n#EXT-X-ENDLIST\n",
+		"720p_000.ts": "segment 0",
+		"720p_001.ts": "segment 1",
+		"poster.jpg":  "poster",
+	}
+	for name, content := range files {
+		if content == "" {
+			delete(output, name)
+			continue
+		}
+		output[name] = content
+	}
+
+	dir := t.TempDir()
+	writeFiles(t, dir, output)
+	cfg := config.Upload{Concurrency: 2, MaxAttempts: 1}
+	if err := uploadDirectory(ctx, store, "content", dir, prefix, nil, cfg); err != nil {
+		t.Fatalf("uploadDirectory() = %v", err)
+	}
+	if err := writeManifest(ctx, store, "content", prefix, t.TempDir(), nil, cfg); err != nil {
+		t.Fatalf("writeManifest() = %v", err)
+	}
+}
+
+func TestCompleteUploadedOutput(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemory()
+	s, _ := retentionService(store, config.SourceRetention{Policy: RetentionPolicyArchive, ArchivePrefix: "archive"})
+	destination := storage.Target{Profile: "default", Bucket: "content", Store: store}
+
+	lesson := &entities.Lesson{Id: uuid.New()}
+	repo := newLessonJobs(lesson)
+	s.repo = repo
+
+	previous := &entities.Job{ID: uuid.New(), EntityId: lesson.Id}
+	previousPrefix := outputPrefixFor("lessons/1", previous.ID)
+	uploadOutput(t, store, previousPrefix, nil)
+	lesson.VideoUrl = path.Join(previousPrefix, "master.m3u8")
+	repo.results[previous.ID] = &entities.JobResult{JobId: previous.ID, Profile: "default", Bucket: "content", ObjectPrefix: previousPrefix}
+
+	job := &entities.Job{ID: uuid.New(), EntityId: lesson.Id}
+	prefix := outputPrefixFor("lessons/1", job.ID)
+	uploadOutput(t, store, prefix, nil)
+	source := upload(t, store, "lessons/1/lesson.mp4")
+
+	err := s.complete(ctx, newJobEvents(repo, config.Events{}, job), dto.JobMessage{JobId: job.ID}, job, destination, prefix, source, t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("complete() = %v", err)
+	}
+
+	masterKey := path.Join(prefix, "master.m3u8")
+	if lesson.VideoUrl != masterKey || repo.status[job.ID] != constant.JobStatusCompleted {
+		t.Errorf("lesson plays %s, job is %s", lesson.VideoUrl, repo.status[job.ID])
+	}
+	result := repo.results[job.ID]
+	if result == nil || result.PlaybackURL != masterKey || result.PosterURL != path.Join(prefix, "poster.jpg") {
+		t.Errorf("result = %+v", result)
+	}
+	if !exists(t, store, path.Join(prefix, manifestFileName)) {
+		t.Error("manifest was not uploaded")
+	}
+
+	retained := repo.sources[lesson.Id]
+	if retained == nil || retained.Policy != RetentionPolicyArchive || !exists(t, store, retained.ObjectKey) || exists(t, store, source.Key) {
+		t.Errorf("retained source = %+v", retained)
+	}
+
+	if exists(t, store, path.Join(previousPrefix, "master.m3u8")) || len(repo.unhashed) != 1 || repo.unhashed[0] != previous.ID {
+		t.Errorf("previous output was not removed, source hashes deleted for %v", repo.unhashed)
+	}
+}
+
+func TestCompleteDiscardsIncompleteOutput(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemory()
+	s, repo := retentionService(store, config.SourceRetention{Policy: RetentionPolicyDelete})
+	destination := storage.Target{Profile: "default", Bucket: "content", Store: store}
+
+	lesson := &entities.Lesson{Id: uuid.New(), VideoUrl: "lessons/1/video.m3u8"}
+	jobs := newLessonJobs(lesson)
+	jobs.lessonSources = repo
+	s.repo = jobs
+
+	job := &entities.Job{ID: uuid.New(), EntityId: lesson.Id}
+	prefix := outputPrefixFor("lessons/1", job.ID)
+	uploadOutput(t, store, prefix, map[string]string{"720p_001.ts": ""})
+	source := upload(t, store, "lessons/1/lesson.mp4")
+
+	err := s.complete(ctx, newJobEvents(jobs, config.Events{}, job), dto.JobMessage{JobId: job.ID}, job, destination, prefix, source, t.TempDir(), nil)
+	if err == nil {
+		t.Fatal("complete() of an output with a missing segment succeeded")
+	}
+
+	if lesson.VideoUrl != "lessons/1/video.m3u8" || jobs.status[job.ID] != "" {
+		t.Errorf("lesson plays %s, job is %s", lesson.VideoUrl, jobs.status[job.ID])
+	}
+	if exists(t, store, path.Join(prefix, "master.m3u8")) {
+		t.Error("unverified output was left behind")
+	}
+	if !exists(t, store, source.Key) {
+		t.Error("source of the failed job was not kept")
+	}
+}
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"worker-transcode/config"
+	"worker-transcode/pkg/storage"
+)
+
+// ladderProfile fingerprints everything that shapes the HLS output so a
+// previous output is only reused when it was produced with the same ladder.
+func ladderProfile(opts config.Transcode) string {
+	var builder strings.Builder
+	for _, r := range resolutions {
+		builder.WriteString(fmt.Sprintf("%dx%d@%s/%s/%g;", r.Width, r.Height, r.Bitrate, r.AudioRate, r.FrameRate))
+	}
+	if opts.HDRVariant {
+		r := hdrResolution
+		builder.WriteString(fmt.Sprintf("hdr:%dx%d@%s/%s/%g;", r.Width, r.Height, r.Bitrate, r.AudioRate, r.FrameRate))
+	}
+
+	sum := sha256.Sum256([]byte(builder.String()))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// copyPrefix copies every object below srcPrefix to dstPrefix, possibly on a
+// different storage profile.
+func copyPrefix(ctx context.Context, src storage.Target, srcPrefix string, dst storage.Target, dstPrefix string) error {
+	srcPrefix = strings.TrimSuffix(srcPrefix, "/") + "/"
+	dstPrefix = strings.TrimSuffix(dstPrefix, "/") + "/"
+
+	objects, err := src.Store.List(ctx, src.Bucket, srcPrefix)
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return fmt.Errorf("no objects found below %s", srcPrefix)
+	}
+
+	for _, object := range objects {
+		relativeKey := strings.TrimPrefix(object.Key, srcPrefix)
+		if strings.HasPrefix(relativeKey, signedPlaylistDir+"/") {
+			continue
+		}
+		if err := storage.CopyObject(ctx, src, object.Key, dst, dstPrefix+relativeKey, storage.CopyOptions{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,237 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"worker-transcode/config"
+	"worker-transcode/entities"
+	"worker-transcode/pkg/storage"
+)
+
+const (
+	DeliveryModePresign = "presign"
+	DeliveryModeCDN     = "cdn"
+	DeliveryModeNone    = "none"
+
+	// signedPlaylistDir holds the copies of the playlists with absolute
+	// signed URIs. They expire with their URLs and are never reused.
+	signedPlaylistDir = "signed"
+)
+
+// urlSigner turns an object key into a URL clients can fetch it from.
+type urlSigner interface {
+	Sign(ctx context.Context, key string) (string, error)
+}
+
+type presignSigner struct {
+	target storage.Target
+	expiry time.Duration
+}
+
+func (p presignSigner) Sign(ctx context.Context, key string) (string, error) {
+	return p.target.Store.Presign(ctx, p.target.Bucket, key, p.expiry)
+}
+
+// cdnSigner produces Cloud CDN style signed URLs: the URL with Expires and
+// KeyName parameters, followed by an HMAC-SHA1 Signature over all of it.
+type cdnSigner struct {
+	baseURL string
+	keyName string
+	key     []byte
+	expires time.Time
+}
+
+func (c cdnSigner) Sign(ctx context.Context, key string) (string, error) {
+	unsigned := fmt.Sprintf("%s/%s?Expires=%d&KeyName=%s",
+		strings.TrimSuffix(c.baseURL, "/"), (&url.URL{Path: key}).EscapedPath(), c.expires.Unix(), url.QueryEscape(c.keyName))
+
+	mac := hmac.New(sha1.New, c.key)
+	mac.Write([]byte(unsigned))
+
+	return unsigned + "&Signature=" + base64.URLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+type keySigner struct{}
+
+func (keySigner) Sign(ctx context.Context, key string) (string, error) {
+	return key, nil
+}
+
+// newURLSigner returns the signer for delivery.mode and when its URLs expire,
+// nil when they do not. In presign mode key is signed once up front, targets
+// whose backend can not presign (SSE-C, memory, local without base_url) get
+// bare object keys instead.
+func newURLSigner(ctx context.Context, cfg config.Delivery, target storage.Target, key string) (urlSigner, *time.Time, error) {
+	expiresAt := time.Now().Add(cfg.Expiry)
+	switch cfg.Mode {
+	case DeliveryModePresign, "":
+		signer := presignSigner{target: target, expiry: cfg.Expiry}
+		if _, err := signer.Sign(ctx, key); errors.Is(err, storage.ErrNotSupported) {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("profile", target.Profile).Msg("storage backend can not presign, delivering object keys")
+			return keySigner{}, nil, nil
+		}
+		return signer, &expiresAt, nil
+	case DeliveryModeCDN:
+		key, err := base64.URLEncoding.DecodeString(cfg.CDN.Key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid CDN signing key: %w", err)
+		}
+		return cdnSigner{baseURL: cfg.CDN.BaseURL, keyName: cfg.CDN.KeyName, key: key, expires: expiresAt}, &expiresAt, nil
+	case DeliveryModeNone:
+		return keySigner{}, nil, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown delivery mode %q", cfg.Mode)
+	}
+}
+
+// signIfExists signs key when the object exists and returns "" otherwise.
+func signIfExists(ctx context.Context, target storage.Target, signer urlSigner, key string) (string, error) {
+	if _, err := target.Store.Stat(ctx, target.Bucket, key); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return signer.Sign(ctx, key)
+}
+
+// rewritePlaylist replaces every URI of an m3u8 playlist, plain URI lines as
+// well as URI attributes, with what rewrite returns for it.
+func rewritePlaylist(reader io.Reader, rewrite func(uri string) (string, error)) (string, error) {
+	var (
+		builder    strings.Builder
+		rewriteErr error
+	)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+		case strings.HasPrefix(trimmed, "#"):
+			line = playlistURIAttribute.ReplaceAllStringFunc(line, func(attribute string) string {
+				uri := playlistURIAttribute.FindStringSubmatch(attribute)[1]
+				rewritten, err := rewrite(uri)
+				if err != nil {
+					rewriteErr = err
+					return attribute
+				}
+				return `URI="` + rewritten + `"`
+			})
+		default:
+			rewritten, err := rewrite(trimmed)
+			if err != nil {
+				return "", err
+			}
+			line = rewritten
+		}
+		if rewriteErr != nil {
+			return "", rewriteErr
+		}
+
+		builder.WriteString(line + "\n")
+	}
+
+	return builder.String(), scanner.Err()
+}
+
+// signPlaylists publishes copies of the master and variant playlists below
+// prefix/signed whose URIs are absolute signed URLs and returns the key of
+// the signed master playlist.
+func signPlaylists(ctx context.Context, target storage.Target, prefix, localDir string, signer urlSigner, metadata map[string]string, cfg config.Upload) (string, error) {
+	signedDir := filepath.Join(localDir, signedPlaylistDir)
+	if err := os.MkdirAll(signedDir, os.ModePerm); err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(signedDir)
+
+	signedPrefix := path.Join(prefix, signedPlaylistDir)
+	publish := func(name string, rewrite func(uri string) (string, error)) (string, error) {
+		reader, err := target.Store.Get(ctx, target.Bucket, path.Join(prefix, name))
+		if err != nil {
+			return "", err
+		}
+		defer reader.Close()
+
+		content, err := rewritePlaylist(reader, rewrite)
+		if err != nil {
+			return "", err
+		}
+
+		localPath := filepath.Join(signedDir, path.Base(name))
+		if err := os.WriteFile(localPath, []byte(content), 0644); err != nil {
+			return "", err
+		}
+
+		key := path.Join(signedPrefix, name)
+		return key, uploadFile(ctx, target.Store, target.Bucket, key, localPath, putOptionsFor(key, metadata, cfg), cfg)
+	}
+
+	masterKey, err := publish("master.m3u8", func(variant string) (string, error) {
+		variantKey, err := publish(variant, func(uri string) (string, error) {
+			return signer.Sign(ctx, path.Join(prefix, path.Dir(variant), uri))
+		})
+		if err != nil {
+			return "", err
+		}
+		return signer.Sign(ctx, variantKey)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return masterKey, nil
+}
+
+// hlsResult builds the job result with the playback, poster and slide URLs of
+// an HLS output.
+func (s service) hlsResult(ctx context.Context, jobId uuid.UUID, target storage.Target, prefix, localDir string, metadata map[string]string) (*entities.JobResult, error) {
+	masterKey := path.Join(prefix, "master.m3u8")
+	signer, expiresAt, err := newURLSigner(ctx, s.cfg.Delivery, target, masterKey)
+	if err != nil {
+		return nil, errors.Join(ErrNonRetryable, err)
+	}
+
+	if _, bare := signer.(keySigner); s.cfg.Delivery.SignPlaylists && !bare {
+		masterKey, err = signPlaylists(ctx, target, prefix, localDir, signer, metadata, s.cfg.Upload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := &entities.JobResult{
+		JobId:        jobId,
+		Profile:      target.Profile,
+		Bucket:       target.Bucket,
+		ObjectPrefix: prefix,
+		ExpiresAt:    expiresAt,
+	}
+	if result.PlaybackURL, err = signer.Sign(ctx, masterKey); err != nil {
+		return nil, err
+	}
+	if result.PosterURL, err = signIfExists(ctx, target, signer, path.Join(prefix, posterFileName)); err != nil {
+		return nil, err
+	}
+	if result.SlidesURL, err = signIfExists(ctx, target, signer, path.Join(prefix, "slides", slideIndexFileName)); err != nil {
+		return nil, err
+	}
+
+	zerolog.Ctx(ctx).Info().Str("mode", s.cfg.Delivery.Mode).Bool("signed_playlists", s.cfg.Delivery.SignPlaylists).Msg("built job result")
+
+	return result, nil
+}
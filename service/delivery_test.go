@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+	"worker-transcode/config"
+	"worker-transcode/pkg/storage"
+)
+
+func TestRewritePlaylist(t *testing.T) {
+	playlist := `#EXTM3U
+#EXT-X-MAP:URI="720p_init.mp4"
+#EXTINF:4.0,
+720p_000.m4s
+
+#EXT-X-ENDLIST
+`
+	want := `#EXTM3U
+#EXT-X-MAP:URI="https://cdn/720p_init.mp4"
+#EXTINF:4.0,
+https://cdn/720p_000.m4s
+
+#EXT-X-ENDLIST
+`
+
+	got, err := rewritePlaylist(strings.NewReader(playlist), func(uri string) (string, error) {
+		return "https://cdn/" + uri, nil
+	})
+	if err != nil {
+		t.Fatalf("rewritePlaylist() = %v", err)
+	}
+	if got != want {
+		t.Errorf("rewritePlaylist() = %q, want %q", got, want)
+	}
+}
+
+func TestRewritePlaylistError(t *testing.T) {
+	failed := errors.New("sign failed")
+	tests := []struct {
+		name     string
+		playlist string
+	}{
+		{"uri line", "#EXTM3U\nsegment.ts\n"},
+		{"uri attribute", "#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\"\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := rewritePlaylist(strings.NewReader(tt.playlist), func(uri string) (string, error) {
+				return "", failed
+			})
+			if !errors.Is(err, failed) {
+				t.Errorf("rewritePlaylist() = %v, want %v", err, failed)
+			}
+		})
+	}
+}
+
+func TestCDNSigner(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	expires := time.Unix(1700000000, 0)
+	signer := cdnSigner{baseURL: "https://cdn.example.com/", keyName: "edge key", key: key, expires: expires}
+
+	signed, err := signer.Sign(context.Background(), "lessons/a b/master.m3u8")
+	if err != nil {
+		t.Fatalf("Sign() = %v", err)
+	}
+
+	unsigned, signature, found := strings.Cut(signed, "&Signature=")
+	if !found {
+		t.Fatalf("Sign() = %q has no signature", signed)
+	}
+	if want := "https://cdn.example.com/lessons/a%20b/master.m3u8?Expires=1700000000&KeyName=edge+key"; unsigned != want {
+		t.Errorf("unsigned URL = %q, want %q", unsigned, want)
+	}
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write([]byte(unsigned))
+	if want := base64.URLEncoding.EncodeToString(mac.Sum(nil)); signature != want {
+		t.Errorf("signature = %q, want %q", signature, want)
+	}
+}
+
+func TestNewURLSigner(t *testing.T) {
+	ctx := context.Background()
+	memory := storage.Target{Profile: "default", Bucket: "content", Store: storage.NewMemory()}
+	local := storage.Target{Profile: "files", Bucket: "content", Store: storage.NewLocal(t.TempDir(), "https://files.example.com")}
+	cdnKey := base64.URLEncoding.EncodeToString([]byte("key"))
+
+	tests := []struct {
+		name    string
+		cfg     config.Delivery
+		target  storage.Target
+		url     string
+		expires bool
+		err     bool
+	}{
+		{"presign", config.Delivery{Mode: DeliveryModePresign}, local, "https://files.example.com/content/hls/master.m3u8", true, false},
+		{"presign unsupported", config.Delivery{Mode: DeliveryModePresign}, memory, "hls/master.m3u8", false, false},
+		{"default mode", config.Delivery{}, memory, "hls/master.m3u8", false, false},
+		{"none", config.Delivery{Mode: DeliveryModeNone}, local, "hls/master.m3u8", false, false},
+		{"cdn", config.Delivery{Mode: DeliveryModeCDN, CDN: config.CDN{BaseURL: "https://cdn", KeyName: "k", Key: cdnKey}}, memory, "https://cdn/hls/master.m3u8?", true, false},
+		{"cdn invalid key", config.Delivery{Mode: DeliveryModeCDN, CDN: config.CDN{Key: "not base64!"}}, memory, "", false, true},
+		{"unknown", config.Delivery{Mode: "magic"}, memory, "", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, expiresAt, err := newURLSigner(ctx, tt.cfg, tt.target, "hls/master.m3u8")
+			if tt.err {
+				if err == nil {
+					t.Error("newURLSigner() succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newURLSigner() = %v", err)
+			}
+			if (expiresAt != nil) != tt.expires {
+				t.Errorf("expiresAt = %v, want expiring %v", expiresAt, tt.expires)
+			}
+
+			url, err := signer.Sign(ctx, "hls/master.m3u8")
+			if err != nil {
+				t.Fatalf("Sign() = %v", err)
+			}
+			if !strings.HasPrefix(url, tt.url) {
+				t.Errorf("Sign() = %q, want prefix %q", url, tt.url)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/rs/zerolog"
+	"time"
+	"worker-transcode/config"
+	"worker-transcode/constant"
+	"worker-transcode/dto"
+	"worker-transcode/entities"
+	"worker-transcode/pkg/failure"
+	"worker-transcode/pkg/storage"
+	"worker-transcode/repository"
+)
+
+// EventPublisher delivers a message to the events exchange once the broker
+// has confirmed it.
+type EventPublisher interface {
+	Publish(ctx context.Context, routingKey string, msg amqp.Publishing) error
+}
+
+// jobEvents records the lifecycle events of one run of a job in the outbox.
+// Recorded in the transaction of the state change they describe, they are
+// published by the outbox relay once it commits.
+type jobEvents struct {
+	repo      repository.JobRepository
+	cfg       config.Events
+	job       *entities.Job
+	startedAt time.Time
+}
+
+func newJobEvents(repo repository.JobRepository, cfg config.Events, job *entities.Job) *jobEvents {
+	return &jobEvents{
+		repo:      repo,
+		cfg:       cfg,
+		job:       job,
+		startedAt: time.Now(),
+	}
+}
+
+func (e *jobEvents) started(ctx context.Context) error {
+	return e.record(ctx, dto.JobEvent{Event: constant.JobEventStarted})
+}
+
+// progress is not tied to a state change, a failure to record it is only
+// logged.
+func (e *jobEvents) progress(ctx context.Context, step string, completed, total int) {
+	err := e.record(ctx, dto.JobEvent{
+		Event:    constant.JobEventProgress,
+		Progress: &dto.JobProgress{Step: step, Completed: completed, Total: total},
+	})
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("failed to record progress event")
+	}
+}
+
+func (e *jobEvents) completed(ctx context.Context, output *dto.JobOutput) error {
+	return e.record(ctx, dto.JobEvent{Event: constant.JobEventCompleted, Output: output})
+}
+
+func (e *jobEvents) failed(ctx context.Context, err error) error {
+	return e.record(ctx, dto.JobEvent{
+		Event:     constant.JobEventFailed,
+		ErrorCode: errorCode(err),
+		Error:     err.Error(),
+	})
+}
+
+func (e *jobEvents) record(ctx context.Context, event dto.JobEvent) error {
+	if !e.cfg.Enabled {
+		return nil
+	}
+
+	event.JobId = e.job.ID
+	event.EntityId = e.job.EntityId
+	event.EntityType = e.job.EntityType
+	event.JobType = e.job.JobType
+	event.OccurredAt = time.Now().UTC()
+	event.DurationMs = time.Since(e.startedAt).Milliseconds()
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return e.repo.SaveOutboxEvent(ctx, &entities.OutboxEvent{
+		ID:         uuid.New(),
+		RoutingKey: string(event.Event),
+		Payload:    string(payload),
+	})
+}
+
+// transition sets the status of the job and records event in one
+// transaction.
+func (e *jobEvents) transition(ctx context.Context, status constant.JobStatus, event func(ctx context.Context) error) error {
+	return e.repo.Transaction(ctx, func(ctx context.Context) error {
+		if err := e.repo.UpdateStatusJob(ctx, status, e.job.ID); err != nil {
+			return err
+		}
+		return event(ctx)
+	})
+}
+
+// errorCode classifies a job failure for consumers of the failed event.
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrIntegrity):
+		return "integrity_check_failed"
+	case errors.Is(err, storage.ErrNotFound):
+		return "object_not_found"
+	case errors.Is(err, storage.ErrUnknownProfile):
+		return "unknown_storage_profile"
+	case errors.Is(err, storage.ErrNotSupported):
+		return "not_supported"
+	case errors.As(err, new(*failure.Error)):
+		return failure.ReasonOf(err)
+	default:
+		return "processing_failed"
+	}
+}
+
+// jobOutput describes a saved job result and the object keys it points to.
+func jobOutput(result *entities.JobResult, keys ...string) *dto.JobOutput {
+	return &dto.JobOutput{
+		Profile:      result.Profile,
+		Bucket:       result.Bucket,
+		ObjectPrefix: result.ObjectPrefix,
+		Keys:         keys,
+		PlaybackURL:  result.PlaybackURL,
+		PosterURL:    result.PosterURL,
+		DownloadURL:  result.DownloadURL,
+		SlidesURL:    result.SlidesURL,
+		ExpiresAt:    result.ExpiresAt,
+	}
+}
@@ -0,0 +1,226 @@
+package service
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"worker-transcode/pkg/storage"
+)
+
+// remoteProtocols is the ffmpeg protocol whitelist for streamed sources, tcp
+// and tls are what http and https run on.
+const remoteProtocols = "http,https,tcp,tls"
+
+// sourceInput is what ffmpeg and ffprobe read the source from, either a
+// downloaded file or a presigned URL streamed over HTTP.
+type sourceInput struct {
+	Location string
+	Remote   bool
+	// Object is the version of a streamed source that was opened. Every read
+	// is pinned to its ETag, a source replaced while it is streamed fails the
+	// read instead of mixing two uploads.
+	Object storage.ObjectInfo
+}
+
+func localInput(path string) sourceInput {
+	return sourceInput{Location: path}
+}
+
+// args returns the input options followed by -i.
+func (in sourceInput) args() []string {
+	if !in.Remote {
+		return []string{"-i", in.Location}
+	}
+
+	args := []string{
+		"-protocol_whitelist", remoteProtocols,
+		"-reconnect", "1",
+		"-reconnect_streamed", "1",
+		"-reconnect_on_network_error", "1",
+		"-reconnect_delay_max", "30",
+	}
+	if etag := strings.Trim(in.Object.ETag, `"`); etag != "" {
+		args = append(args, "-headers", fmt.Sprintf("If-Match: \"%s\"\r\n", etag))
+	}
+
+	return append(args, "-i", in.Location)
+}
+
+// String omits the query of presigned URLs so signatures never end up in logs.
+func (in sourceInput) String() string {
+	if location, _, found := strings.Cut(in.Location, "?"); in.Remote && found {
+		return location
+	}
+
+	return in.Location
+}
+
+// redactArgs replaces the input location in ffmpeg arguments for logging.
+func (in sourceInput) redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == in.Location {
+			arg = in.String()
+		}
+		redacted[i] = arg
+	}
+
+	return redacted
+}
+
+// openSource decides between streaming and downloading the source. Sources
+// of at least input.stream_threshold_mb are read by ffmpeg from a presigned
+// URL, smaller ones are downloaded and verified. The returned hash is empty
+// when a streamed source carries no SHA-256 metadata, see hashSource.
+//
+// Every ffmpeg run reads a streamed source again. ffprobe and the poster only
+// read its header and a frame, the renditions are encoded in a single run,
+// slide extraction reads it once more when requested and hashSource once
+// without SHA-256 metadata. Its integrity is checked by verifyStreamed and
+// hashSource instead of the download.
+func (s service) openSource(ctx context.Context, source objectLocation, localPath string) (sourceInput, string, error) {
+	if s.cfg.Input.StreamThreshold > 0 {
+		info, err := source.Store.Stat(ctx, source.Bucket, source.Key)
+		if err != nil {
+			return sourceInput{}, "", err
+		}
+
+		if s.streams(info.Size) {
+			input, err := s.presignedInput(ctx, source)
+			if err == nil {
+				input.Object = info
+				zerolog.Ctx(ctx).Info().
+					Str("input", input.String()).
+					Int64("size", info.Size).
+					Msg("streaming input file from storage")
+				return input, metadataValue(info.UserMetadata, checksumMetadataKey), nil
+			}
+			if !errors.Is(err, storage.ErrNotSupported) {
+				return sourceInput{}, "", err
+			}
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("storage backend can not presign, downloading input file")
+		}
+	}
+
+	zerolog.Ctx(ctx).Info().Str("input_file", localPath).Msg("downloading input file")
+	sourceHash, err := downloadVerified(ctx, source.Store, source.Bucket, source.Key, localPath, -1)
+	if err != nil {
+		return sourceInput{}, "", err
+	}
+
+	return localInput(localPath), sourceHash, nil
+}
+
+func (s service) streams(size int64) bool {
+	return s.cfg.Input.StreamThreshold > 0 && size >= s.cfg.Input.StreamThreshold
+}
+
+func (s service) presignedInput(ctx context.Context, source objectLocation) (sourceInput, error) {
+	presigned, err := source.Store.Presign(ctx, source.Bucket, source.Key, s.cfg.Input.PresignExpiry)
+	if err != nil {
+		return sourceInput{}, err
+	}
+
+	u, err := url.Parse(presigned)
+	if err != nil {
+		return sourceInput{}, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return sourceInput{}, errors.Join(ErrNonRetryable, fmt.Errorf("refusing to stream input over %q", u.Scheme))
+	}
+	if !hostAllowed(u, s.cfg.Input.AllowedHosts) {
+		return sourceInput{}, errors.Join(ErrNonRetryable, fmt.Errorf("refusing to stream input from %s, host is not allowed", u.Host))
+	}
+
+	return sourceInput{Location: presigned, Remote: true}, nil
+}
+
+// hostAllowed reports whether u points at one of the allowed hosts or a
+// subdomain of one, which is where virtual-host style URLs put the bucket. A
+// port is only compared when both sides name one.
+func hostAllowed(u *url.URL, allowed []string) bool {
+	host := u.Hostname()
+	for _, entry := range allowed {
+		name, port, err := net.SplitHostPort(entry)
+		if err != nil {
+			name, port = entry, ""
+		}
+		if port != "" && u.Port() != "" && port != u.Port() {
+			continue
+		}
+		if host == name || strings.HasSuffix(host, "."+name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// verifyStreamed checks that the streamed source is still the version that
+// was opened. Backends that ignore If-Match would otherwise let a replaced
+// source mix into the output unnoticed.
+func verifyStreamed(ctx context.Context, source objectLocation, input sourceInput) error {
+	info, err := source.Store.Stat(ctx, source.Bucket, source.Key)
+	if err != nil {
+		return err
+	}
+	if info.ETag != input.Object.ETag || info.Size != input.Object.Size {
+		return fmt.Errorf("%w: %s changed while it was streamed, etag %s of %d bytes is now %s of %d bytes",
+			ErrIntegrity, source.Key, input.Object.ETag, input.Object.Size, info.ETag, info.Size)
+	}
+
+	return nil
+}
+
+// hashSource reads the source once more in the background to hash it while
+// ffmpeg streams it, a streamed source is never on disk to be hashed. The
+// read is checked against the size and a plain MD5 ETag of the opened
+// version, like a download. The returned function waits for the SHA-256.
+func hashSource(ctx context.Context, source objectLocation, object storage.ObjectInfo) func() (string, error) {
+	var (
+		sum string
+		err error
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var reader io.ReadCloser
+		reader, err = source.Store.Get(ctx, source.Bucket, source.Key)
+		if err != nil {
+			return
+		}
+		defer reader.Close()
+
+		sha256Hasher := sha256.New()
+		md5Hasher := md5.New()
+		var read int64
+		if read, err = io.Copy(io.MultiWriter(sha256Hasher, md5Hasher), reader); err != nil {
+			return
+		}
+		if read != object.Size {
+			err = fmt.Errorf("%w: read %d of %d bytes of %s", ErrIntegrity, read, object.Size, source.Key)
+			return
+		}
+		if object.ETagIsMD5() {
+			etag := strings.ToLower(strings.Trim(object.ETag, `"`))
+			if md5Sum := hex.EncodeToString(md5Hasher.Sum(nil)); md5Sum != etag {
+				err = fmt.Errorf("%w: md5 of %s is %s, etag is %s", ErrIntegrity, source.Key, md5Sum, etag)
+				return
+			}
+		}
+		sum = hex.EncodeToString(sha256Hasher.Sum(nil))
+	}()
+
+	return func() (string, error) {
+		<-done
+		return sum, err
+	}
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"worker-transcode/pkg/storage"
+)
+
+func TestHostAllowed(t *testing.T) {
+	allowed := []string{"minio:9000", "amazonaws.com", "files.example.com"}
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{"http://minio:9000/content/video.mp4", true},
+		{"http://content.minio:9000/video.mp4", true},
+		{"http://minio:9001/content/video.mp4", false},
+		{"https://content.s3.eu-west-1.amazonaws.com/video.mp4", true},
+		{"https://files.example.com/content/video.mp4", true},
+		{"https://files.example.com:8443/content/video.mp4", true},
+		{"https://evilfiles.example.com/video.mp4", false},
+		{"https://amazonaws.com.evil.net/video.mp4", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hostAllowed(u, allowed); got != tt.allowed {
+				t.Errorf("hostAllowed() = %v, want %v", got, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestSourceInputString(t *testing.T) {
+	tests := []struct {
+		input sourceInput
+		want  string
+	}{
+		{sourceInput{Location: "https://minio/content/video.mp4?X-Amz-Signature=secret", Remote: true}, "https://minio/content/video.mp4"},
+		{localInput("temp/job/input/video?.mp4"), "temp/job/input/video?.mp4"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.input.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestSourceInputArgs(t *testing.T) {
+	tests := []struct {
+		name  string
+		input sourceInput
+		want  []string
+	}{
+		{"local", localInput("input/video.mp4"), []string{"-i", "input/video.mp4"}},
+		{"remote", sourceInput{Location: "https://minio/video.mp4", Remote: true, Object: storage.ObjectInfo{ETag: `"abc"`}}, []string{
+			"-protocol_whitelist", remoteProtocols,
+			"-reconnect", "1",
+			"-reconnect_streamed", "1",
+			"-reconnect_on_network_error", "1",
+			"-reconnect_delay_max", "30",
+			"-headers", "If-Match: \"abc\"\r\n",
+			"-i", "https://minio/video.mp4",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.input.args(); !slices.Equal(got, tt.want) {
+				t.Errorf("args() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func streamedSource(t *testing.T, content string) (objectLocation, storage.ObjectInfo) {
+	t.Helper()
+	store := storage.NewMemory()
+	source := objectLocation{Target: storage.Target{Profile: "default", Bucket: "content", Store: store}, Key: "lessons/1/video.mp4"}
+	if err := store.Put(context.Background(), source.Bucket, source.Key, strings.NewReader(content), int64(len(content)), storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := store.Stat(context.Background(), source.Bucket, source.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return source, info
+}
+
+func TestVerifyStreamed(t *testing.T) {
+	ctx := context.Background()
+	source, info := streamedSource(t, "video")
+	input := sourceInput{Location: "https://minio/video.mp4", Remote: true, Object: info}
+
+	if err := verifyStreamed(ctx, source, input); err != nil {
+		t.Fatalf("verifyStreamed() = %v", err)
+	}
+
+	if err := source.Store.Put(ctx, source.Bucket, source.Key, strings.NewReader("other"), 5, storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyStreamed(ctx, source, input); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("verifyStreamed() of a replaced source = %v, want ErrIntegrity", err)
+	}
+}
+
+func TestHashSource(t *testing.T) {
+	ctx := context.Background()
+	source, info := streamedSource(t, "video")
+	sum := sha256.Sum256([]byte("video"))
+
+	got, err := hashSource(ctx, source, info)()
+	if err != nil || got != hex.EncodeToString(sum[:]) {
+		t.Errorf("hashSource() = %q, %v, want %x", got, err, sum)
+	}
+
+	tests := []struct {
+		name   string
+		object storage.ObjectInfo
+	}{
+		{"size", storage.ObjectInfo{Size: 6, ETag: info.ETag}},
+		{"etag", storage.ObjectInfo{Size: 5, ETag: "9e107d9d372bb6826bd81d3542a419d6"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := hashSource(ctx, source, tt.object)(); !errors.Is(err, ErrIntegrity) {
+				t.Errorf("hashSource() = %v, want ErrIntegrity", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package service
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"worker-transcode/config"
+	"worker-transcode/pkg/storage"
+)
+
+// ErrIntegrity marks a size or checksum mismatch between a local file and the
+// object it was transferred from or to.
+var ErrIntegrity = errors.New("integrity check failed")
+
+const (
+	checksumMetadataKey = "sha256"
+	manifestFileName    = "manifest.json"
+)
+
+type ManifestEntry struct {
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type Manifest struct {
+	Objects []ManifestEntry `json:"objects"`
+}
+
+// failOnIntegrity makes a mismatch fail the job instead of retrying it, a
+// truncated or corrupted object does not fix itself.
+func failOnIntegrity(ctx context.Context, err error) error {
+	if err == nil || !errors.Is(err, ErrIntegrity) || errors.Is(err, ErrNonRetryable) {
+		return err
+	}
+
+	zerolog.Ctx(ctx).Error().Err(err).Str("reason", "checksum_mismatch").Msg("integrity check failed, failing job")
+	return errors.Join(ErrNonRetryable, err)
+}
+
+func metadataValue(metadata map[string]string, key string) string {
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// downloadVerified streams the object to localPath and checks the written
+// bytes against the object's size, its SHA-256 metadata or plain MD5 ETag and,
+// when expectedSize is not negative, the size recorded by the producer. It
+// returns the SHA-256 of the content.
+func downloadVerified(ctx context.Context, store storage.ObjectStore, bucket, objectName, localPath string, expectedSize int64) (string, error) {
+	info, err := store.Stat(ctx, bucket, objectName)
+	if err != nil {
+		return "", err
+	}
+	if expectedSize >= 0 && info.Size != expectedSize {
+		return "", fmt.Errorf("%w: %s is %d bytes in storage, expected %d", ErrIntegrity, objectName, info.Size, expectedSize)
+	}
+
+	object, err := store.Get(ctx, bucket, objectName)
+	if err != nil {
+		return "", err
+	}
+	defer object.Close()
+
+	file, err := os.Create(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	sha256Hasher := sha256.New()
+	md5Hasher := md5.New()
+	written, err := io.Copy(io.MultiWriter(file, sha256Hasher, md5Hasher), object)
+	if err != nil {
+		return "", err
+	}
+
+	if written != info.Size {
+		return "", fmt.Errorf("%w: downloaded %d of %d bytes of %s", ErrIntegrity, written, info.Size, objectName)
+	}
+
+	sum := hex.EncodeToString(sha256Hasher.Sum(nil))
+	if expected := metadataValue(info.UserMetadata, checksumMetadataKey); expected != "" {
+		if !strings.EqualFold(expected, sum) {
+			return "", fmt.Errorf("%w: sha256 of %s is %s, expected %s", ErrIntegrity, objectName, sum, expected)
+		}
+	} else if info.ETagIsMD5() {
+		etag := strings.ToLower(strings.Trim(info.ETag, `"`))
+		if md5Sum := hex.EncodeToString(md5Hasher.Sum(nil)); md5Sum != etag {
+			return "", fmt.Errorf("%w: md5 of %s is %s, etag is %s", ErrIntegrity, objectName, md5Sum, etag)
+		}
+	}
+
+	return sum, nil
+}
+
+func fileSHA256(localPath string) (string, int64, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
+// verifyUploaded checks that the stored object matches what was uploaded.
+func verifyUploaded(ctx context.Context, store storage.ObjectStore, bucket, objectName string, size int64, sum string) error {
+	info, err := store.Stat(ctx, bucket, objectName)
+	if err != nil {
+		return err
+	}
+	if info.Size != size {
+		return fmt.Errorf("%w: %s is %d bytes in storage, uploaded %d", ErrIntegrity, objectName, info.Size, size)
+	}
+	if stored := metadataValue(info.UserMetadata, checksumMetadataKey); stored != "" && !strings.EqualFold(stored, sum) {
+		return fmt.Errorf("%w: %s carries sha256 %s, uploaded %s", ErrIntegrity, objectName, stored, sum)
+	}
+
+	return nil
+}
+
+// writeManifest records the size and SHA-256 of every object below prefix in
+// prefix/manifest.json. Objects without a checksum fail the manifest, which
+// means something below prefix was not written by the worker.
+func writeManifest(ctx context.Context, store storage.ObjectStore, bucket, prefix, localDir string, metadata map[string]string, cfg config.Upload) error {
+	prefix = strings.TrimSuffix(prefix, "/")
+	objects, err := store.List(ctx, bucket, prefix+"/")
+	if err != nil {
+		return err
+	}
+
+	manifestKey := path.Join(prefix, manifestFileName)
+	manifest := Manifest{Objects: make([]ManifestEntry, 0, len(objects))}
+	for _, object := range objects {
+		if object.Key == manifestKey || strings.HasPrefix(object.Key, path.Join(prefix, signedPlaylistDir)+"/") {
+			continue
+		}
+		info, err := store.Stat(ctx, bucket, object.Key)
+		if err != nil {
+			return err
+		}
+		sum := metadataValue(info.UserMetadata, checksumMetadataKey)
+		if sum == "" {
+			return fmt.Errorf("%w: %s has no sha256 metadata", ErrIntegrity, object.Key)
+		}
+		manifest.Objects = append(manifest.Objects, ManifestEntry{
+			Key:    strings.TrimPrefix(object.Key, prefix+"/"),
+			Size:   info.Size,
+			SHA256: sum,
+		})
+	}
+	sort.Slice(manifest.Objects, func(i, j int) bool {
+		return manifest.Objects[i].Key < manifest.Objects[j].Key
+	})
+
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	localPath := filepath.Join(localDir, manifestFileName)
+	if err := os.WriteFile(localPath, content, 0644); err != nil {
+		return err
+	}
+	defer os.Remove(localPath)
+
+	zerolog.Ctx(ctx).Info().
+		Str("manifest", manifestKey).
+		Int("objects", len(manifest.Objects)).
+		Msg("writing checksum manifest")
+
+	return uploadFile(ctx, store, bucket, manifestKey, localPath, putOptionsFor(manifestKey, metadata, cfg), cfg)
+}
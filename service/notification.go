@@ -0,0 +1,251 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"worker-transcode/config"
+	"worker-transcode/constant"
+	"worker-transcode/dto"
+	"worker-transcode/entities"
+	"worker-transcode/pkg/failure"
+	"worker-transcode/pkg/storage"
+	"worker-transcode/repository"
+)
+
+const lessonEntityType = "lesson"
+
+var errDuplicateJob = errors.New("object already claimed by another job")
+
+type NotificationService interface {
+	HandleBucketEvent(ctx context.Context, event dto.BucketEvent) error
+}
+
+type notificationRule struct {
+	config.NotificationRule
+	lessonPattern *regexp.Regexp
+}
+
+type notificationService struct {
+	repo      repository.JobRepository
+	cfg       *config.Config
+	transcode Service
+	rules     []notificationRule
+}
+
+// HandleBucketEvent creates a transcode job for every created object that
+// matches a rule and runs it.
+func (s *notificationService) HandleBucketEvent(ctx context.Context, event dto.BucketEvent) error {
+	for _, record := range event.Records {
+		if !strings.HasPrefix(record.EventName, "s3:ObjectCreated:") {
+			continue
+		}
+
+		bucket := record.S3.Bucket.Name
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("key", record.S3.Object.Key).Msg("invalid object key in bucket event")
+			continue
+		}
+
+		rule, lessonId, ok := s.match(bucket, key)
+		if !ok {
+			zerolog.Ctx(ctx).Debug().Str("bucket", bucket).Str("key", key).Msg("no notification rule matches object")
+			continue
+		}
+
+		if err := s.startJob(ctx, rule, lessonId, bucket, key, strings.Trim(record.S3.Object.ETag, `"`), event.Redelivered); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *notificationService) match(bucket, key string) (notificationRule, uuid.UUID, bool) {
+	for _, rule := range s.rules {
+		if rule.Bucket != "" && rule.Bucket != bucket {
+			continue
+		}
+		if !strings.HasPrefix(key, rule.Prefix) {
+			continue
+		}
+		if len(rule.Extensions) > 0 && !slices.Contains(rule.Extensions, strings.ToLower(path.Ext(key))) {
+			continue
+		}
+
+		match := rule.lessonPattern.FindStringSubmatch(key)
+		if match == nil {
+			continue
+		}
+		lessonId, err := uuid.Parse(match[rule.lessonPattern.SubexpIndex("lesson_id")])
+		if err != nil {
+			continue
+		}
+
+		return rule, lessonId, true
+	}
+
+	return notificationRule{}, uuid.Nil, false
+}
+
+func (s *notificationService) startJob(ctx context.Context, rule notificationRule, lessonId uuid.UUID, bucket, key, etag string, redelivered bool) error {
+	source, err := resolveTarget(s.cfg.Stores, dto.StorageTarget{Profile: rule.Profile, Bucket: bucket})
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Str("profile", rule.Profile).Msg("notification rule names an unknown storage profile")
+		return nil
+	}
+
+	jobId := notificationJobId(source.Profile, bucket, key, etag)
+	claim, err := s.repo.ClaimObject(ctx, &entities.ObjectJob{
+		Profile:   source.Profile,
+		Bucket:    bucket,
+		ObjectKey: key,
+		ETag:      etag,
+		JobId:     jobId,
+	})
+	if err != nil {
+		return err
+	}
+	// A job message claimed the upload first, it runs with its own settings.
+	if claim.JobId != jobId {
+		zerolog.Ctx(ctx).Info().Str("job_id", claim.JobId.String()).Str("key", key).Msg("object already claimed by another job")
+		return nil
+	}
+
+	job, err := s.repo.FindJobById(ctx, claim.JobId)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		job = &entities.Job{
+			ID:         claim.JobId,
+			EntityId:   lessonId,
+			EntityType: lessonEntityType,
+			Status:     constant.JobStatusPending,
+			JobType:    constant.JobTypeTranscoder,
+		}
+		if err := s.repo.CreateJob(ctx, job); err != nil {
+			return err
+		}
+		zerolog.Ctx(ctx).Info().Str("job_id", job.ID.String()).Str("key", key).Msg("created job from bucket notification")
+	case err != nil:
+		return err
+	case job.Status == constant.JobStatusCompleted || job.Status == constant.JobStatusFailed:
+		zerolog.Ctx(ctx).Info().Str("job_id", job.ID.String()).Str("key", key).Msg("object already handled by another job")
+		return nil
+	}
+
+	return s.transcode.Process(ctx, dto.JobMessage{
+		JobId:         job.ID,
+		ObjectPath:    key,
+		FileName:      path.Base(key),
+		ExtractSlides: rule.ExtractSlides,
+		Source:        dto.StorageTarget{Profile: source.Profile, Bucket: bucket},
+		Destination:   dto.StorageTarget{Profile: rule.DestinationProfile, Bucket: rule.DestinationBucket},
+		Redelivered:   redelivered,
+	})
+}
+
+// claimSource claims the uploaded object version for job, before the source
+// is resolved. An upload that is gone was moved or deleted by the retention
+// policy of the job that encoded it, so its newest claim names the owner.
+// While the owner is encoding the upload it fails as waiting, so the message
+// is retried once the owner is done, for at most notifications.claim_wait.
+// When an owner of the same lesson completed within
+// notifications.dedup_window its result is returned for job to link to.
+func (s service) claimSource(ctx context.Context, job *entities.Job, target storage.Target, key string) (*entities.JobResult, error) {
+	var claim *entities.ObjectJob
+	info, err := target.Store.Stat(ctx, target.Bucket, key)
+	switch {
+	case err == nil:
+		claim, err = s.repo.ClaimObject(ctx, &entities.ObjectJob{
+			Profile:   target.Profile,
+			Bucket:    target.Bucket,
+			ObjectKey: key,
+			ETag:      strings.Trim(info.ETag, `"`),
+			JobId:     job.ID,
+		})
+	case errors.Is(err, storage.ErrNotFound):
+		claim, err = s.repo.FindLatestObjectClaim(ctx, target.Profile, target.Bucket, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if claim == nil || claim.JobId == job.ID {
+		return nil, nil
+	}
+
+	owner, err := s.repo.FindJobById(ctx, claim.JobId)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	// A missing owner is a notification that is still being turned into a job.
+	if owner == nil || owner.Status == constant.JobStatusPending || owner.Status == constant.JobStatusProcessing {
+		cause := fmt.Errorf("%w %s", errDuplicateJob, claim.JobId)
+		if time.Since(claim.CreatedAt) >= s.cfg.Notifications.ClaimWait {
+			return nil, failure.NewPermanent("source_claim_timeout", cause)
+		}
+		return nil, failure.NewWaiting("source_claimed", cause)
+	}
+	if owner.EntityId != job.EntityId || owner.Status != constant.JobStatusCompleted || time.Since(owner.UpdatedAt) >= s.cfg.Notifications.DedupWindow {
+		return nil, nil
+	}
+
+	return s.repo.FindJobResult(ctx, owner.ID)
+}
+
+// linkResult completes jobId with the output another job produced from the
+// same upload.
+func (s service) linkResult(ctx context.Context, events *jobEvents, jobId uuid.UUID, owner *entities.JobResult) error {
+	result := *owner
+	result.JobId = jobId
+	result.CreatedAt = time.Time{}
+
+	return s.repo.Transaction(ctx, func(ctx context.Context) error {
+		if err := s.repo.SaveJobResult(ctx, &result); err != nil {
+			return err
+		}
+		if err := s.repo.UpdateStatusJob(ctx, constant.JobStatusCompleted, jobId); err != nil {
+			return err
+		}
+		return events.completed(ctx, jobOutput(&result, path.Join(result.ObjectPrefix, "master.m3u8")))
+	})
+}
+
+// notificationJobId derives the job id of an object version, so a redelivered
+// notification finds the job it created before.
+func notificationJobId(profile, bucket, key, etag string) uuid.UUID {
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte(strings.Join([]string{profile, bucket, key, etag}, "\x00")))
+}
+
+func NewNotificationService(repo repository.JobRepository, cfg *config.Config, transcode Service) (NotificationService, error) {
+	rules := make([]notificationRule, 0, len(cfg.Notifications.Rules))
+	for _, rule := range cfg.Notifications.Rules {
+		pattern, err := regexp.Compile(rule.LessonPattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lesson_pattern %q: %w", rule.LessonPattern, err)
+		}
+		if pattern.SubexpIndex("lesson_id") < 0 {
+			return nil, fmt.Errorf("lesson_pattern %q has no lesson_id group", rule.LessonPattern)
+		}
+		for i, ext := range rule.Extensions {
+			rule.Extensions[i] = strings.ToLower(ext)
+		}
+		rules = append(rules, notificationRule{NotificationRule: rule, lessonPattern: pattern})
+	}
+
+	return &notificationService{
+		repo:      repo,
+		cfg:       cfg,
+		transcode: transcode,
+		rules:     rules,
+	}, nil
+}
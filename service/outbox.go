@@ -0,0 +1,82 @@
+package service
+
+import (
+	"context"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/rs/zerolog"
+	"time"
+	"worker-transcode/config"
+	"worker-transcode/repository"
+)
+
+// RunOutboxRelay publishes recorded events until ctx is done. Every event is
+// marked sent once the broker confirmed it, so it is published at least once.
+// Several workers can run the relay, claimed rows are skipped by the others.
+func RunOutboxRelay(ctx context.Context, repo repository.JobRepository, publisher EventPublisher, cfg *config.Config) {
+	ticker := time.NewTicker(cfg.Outbox.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			sent, err := relayOutbox(ctx, repo, publisher, cfg)
+			if err != nil {
+				zerolog.Ctx(ctx).Warn().Err(err).Msg("failed to relay outbox events")
+				break
+			}
+			if sent < cfg.Outbox.BatchSize {
+				break
+			}
+		}
+
+		if cfg.Outbox.KeepSent > 0 {
+			if err := repo.DeleteSentOutboxEvents(ctx, time.Now().Add(-cfg.Outbox.KeepSent)); err != nil {
+				zerolog.Ctx(ctx).Warn().Err(err).Msg("failed to delete sent outbox events")
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// relayOutbox publishes one batch in order and stops at the first event the
+// broker does not confirm, so later events are not published ahead of it.
+func relayOutbox(ctx context.Context, repo repository.JobRepository, publisher EventPublisher, cfg *config.Config) (int, error) {
+	sent := 0
+	err := repo.Transaction(ctx, func(ctx context.Context) error {
+		events, err := repo.ClaimPendingOutboxEvents(ctx, cfg.Outbox.BatchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, event := range events {
+			publishCtx, cancel := context.WithTimeout(ctx, cfg.Events.ConfirmTimeout)
+			err := publisher.Publish(publishCtx, event.RoutingKey, amqp.Publishing{
+				ContentType: "application/json",
+				MessageId:   event.ID.String(),
+				Type:        event.RoutingKey,
+				Timestamp:   event.CreatedAt,
+				Body:        []byte(event.Payload),
+			})
+			cancel()
+			if err != nil {
+				if markErr := repo.MarkOutboxEventFailed(ctx, event.ID, err.Error()); markErr != nil {
+					return markErr
+				}
+				zerolog.Ctx(ctx).Warn().Err(err).Str("event_id", event.ID.String()).Msg("failed to publish outbox event")
+				return nil
+			}
+
+			if err := repo.MarkOutboxEventSent(ctx, event.ID); err != nil {
+				return err
+			}
+			sent++
+		}
+		return nil
+	})
+
+	return sent, err
+}
@@ -0,0 +1,38 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"os/exec"
+	"strings"
+)
+
+const (
+	posterFileName       = "poster.jpg"
+	posterCheckpointName = "poster"
+)
+
+// extractPoster grabs a frame a little into the video, far enough to skip
+// fades from black, and writes it as a JPEG. HDR sources are tone mapped like
+// the SDR renditions.
+func extractPoster(input sourceInput, info *MediaInfo, outputPath string) error {
+	offset := math.Min(info.Duration*0.1, 5)
+	filters := append(sdrColorFilters(info), "scale='min(1280,iw)':-2")
+
+	ffmpegArgs := append([]string{"-ss", fmt.Sprintf("%.3f", offset)}, input.args()...)
+	ffmpegArgs = append(ffmpegArgs,
+		"-frames:v", "1",
+		"-vf", strings.Join(filters, ","),
+		"-q:v", "2",
+		"-y",
+		outputPath,
+	)
+
+	cmd := exec.Command("ffmpeg", ffmpegArgs...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffmpeg poster extraction failed: %w\nOutput: %s", err, string(output))
+	}
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+type MediaInfo struct {
+	Width             int     `json:"width"`
+	Height            int     `json:"height"`
+	Rotation          int     `json:"rotation"` // clockwise degrees needed to display the picture upright
+	FieldOrder        string  `json:"field_order"`
+	Interlaced        bool    `json:"interlaced"`
+	FrameRate         float64 `json:"frame_rate"`
+	VariableFrameRate bool    `json:"variable_frame_rate"`
+	HasAudio          bool    `json:"has_audio"`
+	Duration          float64 `json:"duration"`
+	PixelFormat       string  `json:"pixel_format"`
+	ColorTransfer     string  `json:"color_transfer"`
+	ColorPrimaries    string  `json:"color_primaries"`
+	ColorSpace        string  `json:"color_space"`
+	HDR               bool    `json:"hdr"` // PQ or HLG transfer characteristics
+}
+
+type ffprobeOutput struct {
+	Streams []ffprobeStream `json:"streams"`
+	Format  struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+}
+
+type ffprobeStream struct {
+	CodecType      string            `json:"codec_type"`
+	Width          int               `json:"width"`
+	Height         int               `json:"height"`
+	FieldOrder     string            `json:"field_order"`
+	RFrameRate     string            `json:"r_frame_rate"`
+	AvgFrameRate   string            `json:"avg_frame_rate"`
+	PixFmt         string            `json:"pix_fmt"`
+	ColorTransfer  string            `json:"color_transfer"`
+	ColorPrimaries string            `json:"color_primaries"`
+	ColorSpace     string            `json:"color_space"`
+	Tags           map[string]string `json:"tags"`
+	SideDataList   []struct {
+		SideDataType string  `json:"side_data_type"`
+		Rotation     float64 `json:"rotation"`
+	} `json:"side_data_list"`
+}
+
+// probe inspects the first video stream of the input with ffprobe so the
+// filter graph can compensate for rotation, interlacing, VFR and HDR sources.
+func probe(ctx context.Context, input sourceInput) (*MediaInfo, error) {
+	args := append([]string{
+		"-v", "error",
+		"-print_format", "json",
+		"-show_streams",
+		"-show_format",
+	}, input.args()...)
+	cmd := exec.Command("ffprobe", args...)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe execution failed: %w", err)
+	}
+
+	var result ffprobeOutput
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse ffprobe output: %w", err)
+	}
+
+	info := &MediaInfo{}
+	var video *ffprobeStream
+	for i := range result.Streams {
+		switch result.Streams[i].CodecType {
+		case "video":
+			if video == nil {
+				video = &result.Streams[i]
+			}
+		case "audio":
+			info.HasAudio = true
+		}
+	}
+	if video == nil {
+		return nil, fmt.Errorf("no video stream found in %s", input)
+	}
+
+	info.Width = video.Width
+	info.Height = video.Height
+	info.Rotation = streamRotation(video)
+
+	info.FieldOrder = video.FieldOrder
+	switch video.FieldOrder {
+	case "tt", "bb", "tb", "bt":
+		info.Interlaced = true
+	}
+
+	realRate := parseFrameRate(video.RFrameRate)
+	avgRate := parseFrameRate(video.AvgFrameRate)
+	info.FrameRate = avgRate
+	if info.FrameRate == 0 {
+		info.FrameRate = realRate
+	}
+	if realRate > 0 && avgRate > 0 && math.Abs(realRate-avgRate)/realRate > 0.01 {
+		info.VariableFrameRate = true
+	}
+
+	info.Duration, _ = strconv.ParseFloat(result.Format.Duration, 64)
+
+	info.PixelFormat = video.PixFmt
+	info.ColorTransfer = video.ColorTransfer
+	info.ColorPrimaries = video.ColorPrimaries
+	info.ColorSpace = video.ColorSpace
+	switch video.ColorTransfer {
+	case "smpte2084", "arib-std-b67":
+		info.HDR = true
+	}
+
+	zerolog.Ctx(ctx).Info().
+		Int("width", info.Width).
+		Int("height", info.Height).
+		Int("rotation", info.Rotation).
+		Str("field_order", info.FieldOrder).
+		Float64("frame_rate", info.FrameRate).
+		Bool("vfr", info.VariableFrameRate).
+		Bool("has_audio", info.HasAudio).
+		Float64("duration", info.Duration).
+		Str("pix_fmt", info.PixelFormat).
+		Str("color_transfer", info.ColorTransfer).
+		Str("color_primaries", info.ColorPrimaries).
+		Bool("hdr", info.HDR).
+		Msg("probed input file")
+
+	return info, nil
+}
+
+// streamRotation normalises the legacy rotate tag and the display matrix side
+// data (which is expressed counter-clockwise) into 0, 90, 180 or 270.
+func streamRotation(stream *ffprobeStream) int {
+	rotation := 0
+	if rotate, ok := stream.Tags["rotate"]; ok {
+		if value, err := strconv.Atoi(rotate); err == nil {
+			rotation = value
+		}
+	} else {
+		for _, sideData := range stream.SideDataList {
+			if sideData.SideDataType == "Display Matrix" {
+				rotation = -int(math.Round(sideData.Rotation))
+				break
+			}
+		}
+	}
+
+	rotation %= 360
+	if rotation < 0 {
+		rotation += 360
+	}
+
+	return (rotation + 45) / 90 * 90 % 360
+}
+
+func parseFrameRate(rate string) float64 {
+	num, den, found := strings.Cut(rate, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	if !found {
+		return n
+	}
+
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+
+	return n / d
+}
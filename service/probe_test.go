@@ -0,0 +1,65 @@
+package service
+
+import (
+	"math"
+	"testing"
+)
+
+func TestStreamRotation(t *testing.T) {
+	displayMatrix := func(rotation float64) *ffprobeStream {
+		stream := &ffprobeStream{}
+		stream.SideDataList = append(stream.SideDataList, struct {
+			SideDataType string  `json:"side_data_type"`
+			Rotation     float64 `json:"rotation"`
+		}{SideDataType: "Display Matrix", Rotation: rotation})
+		return stream
+	}
+
+	tests := []struct {
+		name     string
+		stream   *ffprobeStream
+		rotation int
+	}{
+		{"none", &ffprobeStream{}, 0},
+		{"rotate tag", &ffprobeStream{Tags: map[string]string{"rotate": "90"}}, 90},
+		{"negative rotate tag", &ffprobeStream{Tags: map[string]string{"rotate": "-90"}}, 270},
+		{"invalid rotate tag", &ffprobeStream{Tags: map[string]string{"rotate": "up"}}, 0},
+		{"display matrix counter-clockwise", displayMatrix(-90), 90},
+		{"display matrix clockwise", displayMatrix(90), 270},
+		{"display matrix upside down", displayMatrix(180), 180},
+		{"display matrix off by a few degrees", displayMatrix(-88.5), 90},
+		{"full turn", &ffprobeStream{Tags: map[string]string{"rotate": "360"}}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := streamRotation(tt.stream); got != tt.rotation {
+				t.Errorf("streamRotation() = %d, want %d", got, tt.rotation)
+			}
+		})
+	}
+}
+
+func TestParseFrameRate(t *testing.T) {
+	tests := []struct {
+		rate string
+		fps  float64
+	}{
+		{"30/1", 30},
+		{"30000/1001", 29.97},
+		{"25", 25},
+		{"0/0", 0},
+		{"30/0", 0},
+		{"", 0},
+		{"abc/1", 0},
+		{"30/x", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rate, func(t *testing.T) {
+			if got := parseFrameRate(tt.rate); math.Abs(got-tt.fps) > 0.01 {
+				t.Errorf("parseFrameRate(%q) = %f, want %f", tt.rate, got, tt.fps)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+	"io"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"worker-transcode/dto"
+	"worker-transcode/entities"
+	"worker-transcode/pkg/storage"
+)
+
+var playlistURIAttribute = regexp.MustCompile(`URI="([^"]+)"`)
+
+// outputPrefixFor returns the versioned prefix a job writes its HLS output to.
+// The lesson only points at it once the whole ladder has been verified.
+func outputPrefixFor(lessonPath string, jobId uuid.UUID) string {
+	return strings.ReplaceAll(filepath.Join(lessonPath, "hls", jobId.String()), "\\", "/")
+}
+
+// previousOutput returns the result of the job whose output the lesson plays
+// before it switches to outputPrefix. It is nil when the lesson has no output
+// yet or its output predates versioned prefixes.
+func (s service) previousOutput(ctx context.Context, lessonId uuid.UUID, outputPrefix string) (*entities.JobResult, error) {
+	lesson, err := s.repo.FindLessonById(ctx, lessonId)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := path.Dir(lesson.VideoUrl)
+	if lesson.VideoUrl == "" || prefix == outputPrefix || path.Base(path.Dir(prefix)) != "hls" {
+		return nil, nil
+	}
+	jobId, err := uuid.Parse(path.Base(prefix))
+	if err != nil {
+		return nil, nil
+	}
+
+	result, err := s.repo.FindJobResult(ctx, jobId)
+	if err != nil || result == nil || result.ObjectPrefix != prefix {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// removeOutput deletes the output of a previous version of the lesson. Its
+// source hash goes first so no later job copies from a half deleted prefix.
+func (s service) removeOutput(ctx context.Context, result *entities.JobResult) error {
+	target, err := resolveTarget(s.cfg.Stores, dto.StorageTarget{Profile: result.Profile, Bucket: result.Bucket})
+	if err != nil {
+		return err
+	}
+	if err := s.repo.DeleteSourceHashes(ctx, result.JobId); err != nil {
+		return err
+	}
+
+	return removePrefix(ctx, target.Store, target.Bucket, result.ObjectPrefix)
+}
+
+// playlistURIs returns the media URIs referenced by an m3u8 playlist, both
+// plain URI lines and URI attributes (EXT-X-MEDIA, EXT-X-MAP).
+func playlistURIs(reader io.Reader) ([]string, error) {
+	var uris []string
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			for _, match := range playlistURIAttribute.FindAllStringSubmatch(line, -1) {
+				uris = append(uris, match[1])
+			}
+			continue
+		}
+		uris = append(uris, line)
+	}
+
+	return uris, scanner.Err()
+}
+
+func readPlaylistURIs(ctx context.Context, store storage.ObjectStore, bucket, key string) ([]string, error) {
+	reader, err := store.Get(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return playlistURIs(reader)
+}
+
+// verifyHLSOutput walks master.m3u8 below prefix and checks that every
+// referenced playlist, init section and segment exists in storage.
+func verifyHLSOutput(ctx context.Context, store storage.ObjectStore, bucket, prefix string) error {
+	masterKey := path.Join(prefix, "master.m3u8")
+	playlists, err := readPlaylistURIs(ctx, store, bucket, masterKey)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", masterKey, err)
+	}
+	if len(playlists) == 0 {
+		return fmt.Errorf("%s references no playlists", masterKey)
+	}
+
+	checked := 0
+	for _, playlist := range playlists {
+		playlistKey := path.Join(prefix, playlist)
+		segments, err := readPlaylistURIs(ctx, store, bucket, playlistKey)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", playlistKey, err)
+		}
+		if len(segments) == 0 {
+			return fmt.Errorf("%s references no segments", playlistKey)
+		}
+
+		for _, segment := range segments {
+			segmentKey := path.Join(path.Dir(playlistKey), segment)
+			if _, err := store.Stat(ctx, bucket, segmentKey); err != nil {
+				return fmt.Errorf("missing %s: %w", segmentKey, err)
+			}
+			checked++
+		}
+	}
+
+	zerolog.Ctx(ctx).Info().
+		Str("prefix", prefix).
+		Int("playlists", len(playlists)).
+		Int("segments", checked).
+		Msg("hls output verified")
+
+	return nil
+}
+
+// removePrefix deletes every object below prefix.
+func removePrefix(ctx context.Context, store storage.ObjectStore, bucket, prefix string) error {
+	return removeObjects(ctx, store, bucket, prefix, func(string) bool { return true })
+}
+
+// removeRenditionObjects deletes what a previous, interrupted attempt left
+// behind for a rendition so new segments are never mixed with old ones.
+func removeRenditionObjects(ctx context.Context, store storage.ObjectStore, bucket, prefix, renditionName string) error {
+	return removeObjects(ctx, store, bucket, prefix, func(name string) bool {
+		return name == renditionName+".m3u8" || strings.HasPrefix(name, renditionName+"_")
+	})
+}
+
+func removeObjects(ctx context.Context, store storage.ObjectStore, bucket, prefix string, match func(name string) bool) error {
+	objects, err := store.List(ctx, bucket, strings.TrimSuffix(prefix, "/")+"/")
+	if err != nil {
+		return err
+	}
+
+	for _, object := range objects {
+		if !match(path.Base(object.Key)) {
+			continue
+		}
+		if err := store.Remove(ctx, bucket, object.Key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
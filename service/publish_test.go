@@ -0,0 +1,64 @@
+package service
+
+import (
+	"github.com/google/uuid"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestOutputPrefixFor(t *testing.T) {
+	jobId := uuid.MustParse("6f1c2a3e-8d4b-4c1a-9e2f-0a1b2c3d4e5f")
+	if got := outputPrefixFor("lessons/42", jobId); got != "lessons/42/hls/"+jobId.String() {
+		t.Errorf("outputPrefixFor() = %q", got)
+	}
+}
+
+func TestPlaylistURIs(t *testing.T) {
+	tests := []struct {
+		name     string
+		playlist string
+		uris     []string
+	}{
+		{
+			name: "master",
+			playlist: `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="audio",URI="audio.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,AUDIO="aac"
+360p.m3u8
+
+#EXT-X-STREAM-INF:BANDWIDTH=2800000,RESOLUTION=1280x720,AUDIO="aac"
+  720p.m3u8
+`,
+			uris: []string{"audio.m3u8", "360p.m3u8", "720p.m3u8"},
+		},
+		{
+			name: "fmp4 variant",
+			playlist: `#EXTM3U
+#EXT-X-MAP:URI="720p_init.mp4"
+#EXTINF:4.0,
+720p_000.m4s
+#EXTINF:4.0,
+720p_001.m4s
+#EXT-X-ENDLIST
+`,
+			uris: []string{"720p_init.mp4", "720p_000.m4s", "720p_001.m4s"},
+		},
+		{
+			name:     "empty",
+			playlist: "#EXTM3U\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uris, err := playlistURIs(strings.NewReader(tt.playlist))
+			if err != nil {
+				t.Fatalf("playlistURIs() = %v", err)
+			}
+			if !slices.Equal(uris, tt.uris) {
+				t.Errorf("playlistURIs() = %v, want %v", uris, tt.uris)
+			}
+		})
+	}
+}
@@ -4,19 +4,28 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"github.com/minio/minio-go/v7"
+	"github.com/google/uuid"
 	"github.com/rs/zerolog"
+	"gorm.io/gorm"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"strings"
 	"worker-transcode/config"
 	"worker-transcode/constant"
 	"worker-transcode/dto"
 	"worker-transcode/entities"
+	"worker-transcode/pkg/failure"
+	"worker-transcode/pkg/scratch"
+	"worker-transcode/pkg/storage"
 	"worker-transcode/repository"
 )
 
+// recordingMergeSteps are the steps reported in progress events: download,
+// merge and upload.
+const recordingMergeSteps = 3
+
 type RecordingMergeService interface {
 	ProcessRecordingMerge(ctx context.Context, message dto.RecordingMergeMessage) error
 }
@@ -33,6 +42,10 @@ func (s *recordingMergeService) ProcessRecordingMerge(ctx context.Context, messa
 		Msg("processing recording merge job")
 
 	job, err := s.repo.FindJobById(ctx, message.JobId)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("job does not exist")
+		return failure.NewPermanent("job_not_found", err)
+	}
 	if err != nil {
 		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to find job by id")
 		return err
@@ -43,18 +56,25 @@ func (s *recordingMergeService) ProcessRecordingMerge(ctx context.Context, messa
 		return nil
 	}
 
-	if err := s.repo.UpdateStatusJob(ctx, constant.JobStatusProcessing, message.JobId); err != nil {
+	events := newJobEvents(s.repo, s.cfg.Events, job)
+	if err := events.transition(ctx, constant.JobStatusProcessing, events.started); err != nil {
 		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to update job status")
 		return err
 	}
 
 	defer func() {
+		err = failOnIntegrity(ctx, err)
 		if err != nil {
-			if errors.Is(err, ErrNonRetryable) {
-				if updateErr := s.repo.UpdateStatusJob(ctx, constant.JobStatusFailed, message.JobId); updateErr != nil {
+			if errors.Is(err, ErrNonRetryable) || failure.Final(ctx, err) {
+				cause := err
+				if updateErr := events.transition(ctx, constant.JobStatusFailed, func(ctx context.Context) error {
+					return events.failed(ctx, cause)
+				}); updateErr != nil {
 					zerolog.Ctx(ctx).Error().Err(updateErr).Msg("failed to update job status")
 				}
-				err = nil
+				if errors.Is(err, ErrNonRetryable) {
+					err = nil
+				}
 			} else {
 				if updateErr := s.repo.UpdateStatusJob(ctx, constant.JobStatusPending, message.JobId); updateErr != nil {
 					zerolog.Ctx(ctx).Error().Err(updateErr).Msg("failed to update job status")
@@ -63,6 +83,17 @@ func (s *recordingMergeService) ProcessRecordingMerge(ctx context.Context, messa
 		}
 	}()
 
+	source, err := resolveTarget(s.cfg.Stores, message.Source)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to resolve source storage")
+		return err
+	}
+	destination, err := resolveTarget(s.cfg.Stores, message.Destination)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to resolve destination storage")
+		return err
+	}
+
 	// Get recording chunks from database
 	zerolog.Ctx(ctx).Info().Msg("fetching recording chunks from database")
 	chunks, err := s.repo.GetRecordingChunksByLiveSessionId(ctx, message.LiveSessionId)
@@ -101,8 +132,25 @@ func (s *recordingMergeService) ProcessRecordingMerge(ctx context.Context, messa
 		}
 	}
 
+	// Reserve room for the chunks, their MP4 conversions and the merged file
+	var chunkBytes uint64
+	for _, chunk := range chunks {
+		if chunk.FileSize != nil {
+			chunkBytes += uint64(*chunk.FileSize)
+		}
+	}
+	release, err := s.cfg.Scratch.Reserve(message.JobId.String(), 3*chunkBytes)
+	if errors.Is(err, scratch.ErrInsufficientSpace) {
+		err = failure.NewResourceExhausted("insufficient_scratch_space", err)
+	}
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to reserve scratch space")
+		return err
+	}
+	defer release()
+
 	// Create temporary directories
-	tempDir := filepath.Join("temp", message.JobId.String())
+	tempDir := s.cfg.Scratch.JobDir(message.JobId.String())
 	defer os.RemoveAll(tempDir)
 
 	chunksDir := filepath.Join(tempDir, "chunks")
@@ -119,7 +167,7 @@ func (s *recordingMergeService) ProcessRecordingMerge(ctx context.Context, messa
 
 	// Download all chunks from MinIO using object_name from database
 	zerolog.Ctx(ctx).Info().Int("total_chunks", len(chunks)).Msg("starting to download chunks from MinIO")
-	chunkPaths, err := s.downloadChunks(ctx, chunks, chunksDir)
+	chunkPaths, err := s.downloadChunks(ctx, source, chunks, chunksDir)
 	if err != nil {
 		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to download chunks")
 		return err
@@ -135,6 +183,7 @@ func (s *recordingMergeService) ProcessRecordingMerge(ctx context.Context, messa
 		Int("chunk_count", len(chunkPaths)).
 		Strs("downloaded_files", chunkPaths).
 		Msg("all chunks downloaded successfully")
+	events.progress(ctx, "download", 1, recordingMergeSteps)
 
 	// Merge chunks using FFmpeg
 	outputFileName := "final.mp4"
@@ -159,6 +208,7 @@ func (s *recordingMergeService) ProcessRecordingMerge(ctx context.Context, messa
 		Str("output_file", outputFilePath).
 		Int("merged_chunks", len(chunkPaths)).
 		Msg("chunks merged successfully with FFmpeg")
+	events.progress(ctx, "merge", 2, recordingMergeSteps)
 
 	// Build output path: live-recordings/{sessionId}/final/recording.mp4
 	// Get session folder from chunk path (e.g., live-recordings/{sessionId}/chunks/chunk_0000.webm -> live-recordings/{sessionId})
@@ -168,21 +218,43 @@ func (s *recordingMergeService) ProcessRecordingMerge(ctx context.Context, messa
 	outputKey = strings.ReplaceAll(outputKey, "\\", "/")
 
 	zerolog.Ctx(ctx).Info().Str("output_key", outputKey).Msg("uploading final video to MinIO")
-	_, err = s.cfg.Storage.FPutObject(ctx, s.cfg.MinIOBucket, outputKey, outputFilePath, minio.PutObjectOptions{
-		ContentType: "video/mp4",
-	})
+	metadata := map[string]string{
+		"job-id":          message.JobId.String(),
+		"live-session-id": message.LiveSessionId.String(),
+	}
+	err = uploadFile(ctx, destination.Store, destination.Bucket, outputKey, outputFilePath, putOptionsFor(outputKey, metadata, s.cfg.Upload), s.cfg.Upload)
 	if err != nil {
 		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to upload final video")
 		return err
 	}
+	events.progress(ctx, "upload", 3, recordingMergeSteps)
 
-	// Update chunks status to COMPLETED
-	for _, chunk := range chunks {
-		if err := s.repo.UpdateRecordingChunkStatus(ctx, chunk.ID, "COMPLETED"); err != nil {
-			zerolog.Ctx(ctx).Warn().Err(err).Str("chunk_id", chunk.ID.String()).Msg("failed to update chunk status to COMPLETED")
+	finalPrefix := path.Dir(outputKey)
+	if err = writeManifest(ctx, destination.Store, destination.Bucket, finalPrefix, tempDir, metadata, s.cfg.Upload); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to write checksum manifest")
+		return err
+	}
+
+	if message.ExtractSlides {
+		slidesDir := filepath.Join(tempDir, "slides")
+		slidesPrefix := strings.ReplaceAll(filepath.Join(sessionFolder, "slides"), "\\", "/")
+
+		zerolog.Ctx(ctx).Info().Str("slides_prefix", slidesPrefix).Msg("extracting slides from merged recording")
+		_, slideErr := extractSlides(ctx, localInput(outputFilePath), tempDir, slidesDir, s.cfg.Slides.SceneThreshold, s.cfg.Slides.MaxHashDistance)
+		if slideErr == nil {
+			slideErr = uploadDirectory(ctx, destination.Store, destination.Bucket, slidesDir, slidesPrefix, metadata, s.cfg.Upload)
+		}
+		if slideErr != nil {
+			zerolog.Ctx(ctx).Warn().Err(slideErr).Msg("failed to extract slides, continuing without them")
 		}
 	}
 
+	result, err := s.result(ctx, message.JobId, destination, sessionFolder, outputKey)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to build job result")
+		return err
+	}
+
 	// Calculate total recording duration from chunks
 	totalDuration := 0
 	for _, chunk := range chunks {
@@ -199,18 +271,27 @@ func (s *recordingMergeService) ProcessRecordingMerge(ctx context.Context, messa
 		Int("total_chunks", len(chunks)).
 		Msg("updating live_sessions with recording information")
 
-	if err = s.repo.UpdateLiveSessionRecording(ctx, message.LiveSessionId, "COMPLETED", outputKey, totalDuration, len(chunks)); err != nil {
-		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to update live_sessions")
-		// Don't return error, just log it - job is still successful
-	} else {
-		zerolog.Ctx(ctx).Info().
-			Str("live_session_id", message.LiveSessionId.String()).
-			Msg("live_sessions updated successfully")
-	}
-
-	// Update job status to completed
-	if err = s.repo.UpdateStatusJob(ctx, constant.JobStatusCompleted, message.JobId); err != nil {
-		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to update job status")
+	// The chunks, the live session, the job result and the job status change
+	// together with the completed event.
+	err = s.repo.Transaction(ctx, func(ctx context.Context) error {
+		for _, chunk := range chunks {
+			if err := s.repo.UpdateRecordingChunkStatus(ctx, chunk.ID, "COMPLETED"); err != nil {
+				return err
+			}
+		}
+		if err := s.repo.UpdateLiveSessionRecording(ctx, message.LiveSessionId, "COMPLETED", outputKey, totalDuration, len(chunks)); err != nil {
+			return err
+		}
+		if err := s.repo.SaveJobResult(ctx, result); err != nil {
+			return err
+		}
+		if err := s.repo.UpdateStatusJob(ctx, constant.JobStatusCompleted, message.JobId); err != nil {
+			return err
+		}
+		return events.completed(ctx, jobOutput(result, outputKey))
+	})
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to complete recording merge job")
 		return err
 	}
 
@@ -225,7 +306,7 @@ func (s *recordingMergeService) ProcessRecordingMerge(ctx context.Context, messa
 	return nil
 }
 
-func (s *recordingMergeService) downloadChunks(ctx context.Context, chunks []*entities.RecordingChunk, localDir string) ([]string, error) {
+func (s *recordingMergeService) downloadChunks(ctx context.Context, source storage.Target, chunks []*entities.RecordingChunk, localDir string) ([]string, error) {
 	var chunkPaths []string
 
 	zerolog.Ctx(ctx).Info().
@@ -249,7 +330,11 @@ func (s *recordingMergeService) downloadChunks(ctx context.Context, chunks []*en
 			Interface("file_size", chunk.FileSize).
 			Msg("downloading chunk from MinIO")
 
-		err := s.cfg.Storage.FGetObject(ctx, s.cfg.MinIOBucket, objectName, localPath, minio.GetObjectOptions{})
+		expectedSize := int64(-1)
+		if chunk.FileSize != nil {
+			expectedSize = *chunk.FileSize
+		}
+		_, err := downloadVerified(ctx, source.Store, source.Bucket, objectName, localPath, expectedSize)
 		if err != nil {
 			zerolog.Ctx(ctx).Error().
 				Err(err).
@@ -283,6 +368,31 @@ func (s *recordingMergeService) downloadChunks(ctx context.Context, chunks []*en
 	return chunkPaths, nil
 }
 
+// result builds the job result with the download URL of the merged recording
+// and, when slides were extracted, of their index.
+func (s *recordingMergeService) result(ctx context.Context, jobId uuid.UUID, target storage.Target, sessionFolder, outputKey string) (*entities.JobResult, error) {
+	signer, expiresAt, err := newURLSigner(ctx, s.cfg.Delivery, target, outputKey)
+	if err != nil {
+		return nil, errors.Join(ErrNonRetryable, err)
+	}
+
+	result := &entities.JobResult{
+		JobId:        jobId,
+		Profile:      target.Profile,
+		Bucket:       target.Bucket,
+		ObjectPrefix: sessionFolder,
+		ExpiresAt:    expiresAt,
+	}
+	if result.DownloadURL, err = signer.Sign(ctx, outputKey); err != nil {
+		return nil, err
+	}
+	if result.SlidesURL, err = signIfExists(ctx, target, signer, path.Join(sessionFolder, "slides", slideIndexFileName)); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
 func mergeWebMChunks(ctx context.Context, chunkPaths []string, outputPath string) error {
 	if len(chunkPaths) == 0 {
 		return fmt.Errorf("no chunks to merge")
@@ -0,0 +1,171 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/rs/zerolog"
+	"path"
+	"worker-transcode/dto"
+	"worker-transcode/entities"
+	"worker-transcode/pkg/storage"
+)
+
+const (
+	RetentionPolicyDelete  = "delete"
+	RetentionPolicyKeep    = "keep"
+	RetentionPolicyArchive = "archive"
+)
+
+type objectLocation struct {
+	storage.Target
+	Key string
+}
+
+// resolveSource prefers the upload referenced by the message and falls back
+// to the retained source of the lesson, which is what re-transcode jobs use.
+func (s service) resolveSource(ctx context.Context, job *entities.Job, target storage.Target, objectPath string) (objectLocation, error) {
+	location := objectLocation{Target: target, Key: objectPath}
+	_, err := target.Store.Stat(ctx, location.Bucket, location.Key)
+	if err == nil || !errors.Is(err, storage.ErrNotFound) {
+		return location, err
+	}
+
+	retained, findErr := s.repo.FindLessonSource(ctx, job.EntityId)
+	if findErr != nil {
+		return location, findErr
+	}
+	if retained == nil {
+		return location, errors.Join(ErrNonRetryable, err)
+	}
+
+	zerolog.Ctx(ctx).Info().
+		Str("profile", retained.Profile).
+		Str("bucket", retained.Bucket).
+		Str("object", retained.ObjectKey).
+		Msg("upload not found, using retained lesson source")
+
+	retainedTarget, err := resolveTarget(s.cfg.Stores, dto.StorageTarget{Profile: retained.Profile, Bucket: retained.Bucket})
+	if err != nil {
+		return location, err
+	}
+
+	return objectLocation{Target: retainedTarget, Key: retained.ObjectKey}, nil
+}
+
+// retainSource applies the configured retention policy to the source once the
+// lesson points at the new output. Archives are kept per job, a re-upload
+// never overwrites the archive of an earlier one, which is removed instead
+// once the lesson retains the new source.
+func (s service) retainSource(ctx context.Context, job *entities.Job, source objectLocation) error {
+	previous, err := s.repo.FindLessonSource(ctx, job.EntityId)
+	if err != nil {
+		return err
+	}
+
+	retention := s.cfg.Retention
+	var retained *objectLocation
+	switch retention.Policy {
+	case RetentionPolicyKeep:
+		err := s.repo.SaveLessonSource(ctx, &entities.LessonSource{
+			LessonId:  job.EntityId,
+			Profile:   source.Profile,
+			Bucket:    source.Bucket,
+			ObjectKey: source.Key,
+			Policy:    RetentionPolicyKeep,
+			JobId:     job.ID,
+		})
+		if err != nil {
+			return err
+		}
+		retained = &source
+	case RetentionPolicyArchive:
+		archiveTarget := source.Target
+		if retention.ArchiveProfile != "" || retention.ArchiveBucket != "" {
+			var err error
+			archiveTarget, err = resolveTarget(s.cfg.Stores, dto.StorageTarget{Profile: retention.ArchiveProfile, Bucket: retention.ArchiveBucket})
+			if err != nil {
+				return err
+			}
+		}
+		archive := objectLocation{
+			Target: archiveTarget,
+			Key:    path.Join(retention.ArchivePrefix, job.EntityId.String(), job.ID.String(), path.Base(source.Key)),
+		}
+		// A re-transcode reads the archive of the lesson, which stays where
+		// it is.
+		if previous != nil && previous.Policy == RetentionPolicyArchive && retainedAt(previous, source) {
+			archive = source
+		}
+
+		if archive != source {
+			zerolog.Ctx(ctx).Info().
+				Str("bucket", archive.Bucket).
+				Str("object", archive.Key).
+				Str("storage_class", retention.StorageClass).
+				Msg("archiving original file")
+			err := storage.CopyObject(ctx, source.Target, source.Key, archive.Target, archive.Key, storage.CopyOptions{
+				StorageClass: retention.StorageClass,
+			})
+			if err != nil {
+				return err
+			}
+			if err := source.Store.Remove(ctx, source.Bucket, source.Key); err != nil {
+				return err
+			}
+		}
+
+		err := s.repo.SaveLessonSource(ctx, &entities.LessonSource{
+			LessonId:     job.EntityId,
+			Profile:      archive.Profile,
+			Bucket:       archive.Bucket,
+			ObjectKey:    archive.Key,
+			Policy:       RetentionPolicyArchive,
+			StorageClass: retention.StorageClass,
+			JobId:        job.ID,
+		})
+		if err != nil {
+			return err
+		}
+		retained = &archive
+	default:
+		zerolog.Ctx(ctx).Info().Msg("deleting original file")
+		if err := source.Store.Remove(ctx, source.Bucket, source.Key); err != nil {
+			return err
+		}
+
+		if err := s.repo.DeleteLessonSource(ctx, job.EntityId); err != nil {
+			return err
+		}
+	}
+
+	// The source itself was moved or removed above already.
+	if previous == nil || retainedAt(previous, source) || (retained != nil && retainedAt(previous, *retained)) {
+		return nil
+	}
+
+	return s.removeRetained(ctx, previous)
+}
+
+// retainedAt reports whether the retained source is stored at location.
+func retainedAt(retained *entities.LessonSource, location objectLocation) bool {
+	return retained.Profile == location.Profile && retained.Bucket == location.Bucket && retained.ObjectKey == location.Key
+}
+
+// removeRetained removes a retained source the lesson no longer points at.
+func (s service) removeRetained(ctx context.Context, retained *entities.LessonSource) error {
+	target, err := resolveTarget(s.cfg.Stores, dto.StorageTarget{Profile: retained.Profile, Bucket: retained.Bucket})
+	if err != nil {
+		return err
+	}
+
+	zerolog.Ctx(ctx).Info().
+		Str("bucket", retained.Bucket).
+		Str("object", retained.ObjectKey).
+		Msg("removing previously retained source")
+	err = target.Store.Remove(ctx, target.Bucket, retained.ObjectKey)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+
+	return nil
+}
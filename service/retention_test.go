@@ -0,0 +1,127 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"strings"
+	"testing"
+	"worker-transcode/config"
+	"worker-transcode/entities"
+	"worker-transcode/pkg/storage"
+	"worker-transcode/repository"
+)
+
+// lessonSources keeps the retained sources of lessons in memory, every other
+// repository method panics.
+type lessonSources struct {
+	repository.JobRepository
+	sources map[uuid.UUID]*entities.LessonSource
+}
+
+func (r *lessonSources) FindLessonSource(_ context.Context, lessonId uuid.UUID) (*entities.LessonSource, error) {
+	return r.sources[lessonId], nil
+}
+
+func (r *lessonSources) SaveLessonSource(_ context.Context, source *entities.LessonSource) error {
+	r.sources[source.LessonId] = source
+	return nil
+}
+
+func (r *lessonSources) DeleteLessonSource(_ context.Context, lessonId uuid.UUID) error {
+	delete(r.sources, lessonId)
+	return nil
+}
+
+func retentionService(store storage.ObjectStore, retention config.SourceRetention) (service, *lessonSources) {
+	stores := storage.NewRegistry("default")
+	stores.Register("default", store, "content")
+	repo := &lessonSources{sources: make(map[uuid.UUID]*entities.LessonSource)}
+
+	return service{repo: repo, cfg: &config.Config{Stores: stores, Retention: retention}}, repo
+}
+
+func upload(t *testing.T, store storage.ObjectStore, key string) objectLocation {
+	t.Helper()
+	if err := store.Put(context.Background(), "content", key, strings.NewReader("video"), 5, storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	return objectLocation{Target: storage.Target{Profile: "default", Bucket: "content", Store: store}, Key: key}
+}
+
+func exists(t *testing.T, store storage.ObjectStore, key string) bool {
+	t.Helper()
+	_, err := store.Stat(context.Background(), "content", key)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		t.Fatal(err)
+	}
+
+	return err == nil
+}
+
+func TestRetainSourceArchivesEveryUpload(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemory()
+	s, repo := retentionService(store, config.SourceRetention{Policy: RetentionPolicyArchive, ArchivePrefix: "archive"})
+	lessonId := uuid.New()
+
+	first := &entities.Job{ID: uuid.New(), EntityId: lessonId}
+	if err := s.retainSource(ctx, first, upload(t, store, "uploads/video.mp4")); err != nil {
+		t.Fatalf("retainSource() = %v", err)
+	}
+	firstArchive := repo.sources[lessonId].ObjectKey
+	if firstArchive != "archive/"+lessonId.String()+"/"+first.ID.String()+"/video.mp4" {
+		t.Errorf("archive key = %s", firstArchive)
+	}
+
+	// A re-transcode keeps the archive it read.
+	retranscode := &entities.Job{ID: uuid.New(), EntityId: lessonId}
+	archived := objectLocation{Target: storage.Target{Profile: "default", Bucket: "content", Store: store}, Key: firstArchive}
+	if err := s.retainSource(ctx, retranscode, archived); err != nil {
+		t.Fatalf("retainSource() = %v", err)
+	}
+	if repo.sources[lessonId].ObjectKey != firstArchive || !exists(t, store, firstArchive) {
+		t.Errorf("re-transcode moved the archive to %s", repo.sources[lessonId].ObjectKey)
+	}
+
+	// A re-upload with the same name replaces the archive of the lesson.
+	second := &entities.Job{ID: uuid.New(), EntityId: lessonId}
+	if err := s.retainSource(ctx, second, upload(t, store, "uploads/video.mp4")); err != nil {
+		t.Fatalf("retainSource() = %v", err)
+	}
+	secondArchive := repo.sources[lessonId].ObjectKey
+	if secondArchive == firstArchive || !exists(t, store, secondArchive) {
+		t.Errorf("re-upload archived to %s, first archive %s", secondArchive, firstArchive)
+	}
+	if exists(t, store, firstArchive) {
+		t.Error("archive of the first upload was left behind")
+	}
+	if exists(t, store, "uploads/video.mp4") {
+		t.Error("upload was not removed after archiving")
+	}
+}
+
+func TestRetainSourceRemovesReplacedSource(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemory()
+	lessonId := uuid.New()
+
+	keep, repo := retentionService(store, config.SourceRetention{Policy: RetentionPolicyKeep})
+	if err := keep.retainSource(ctx, &entities.Job{ID: uuid.New(), EntityId: lessonId}, upload(t, store, "uploads/first.mp4")); err != nil {
+		t.Fatalf("retainSource() = %v", err)
+	}
+
+	remove, _ := retentionService(store, config.SourceRetention{Policy: RetentionPolicyDelete})
+	remove.repo = repo
+	if err := remove.retainSource(ctx, &entities.Job{ID: uuid.New(), EntityId: lessonId}, upload(t, store, "uploads/second.mp4")); err != nil {
+		t.Fatalf("retainSource() = %v", err)
+	}
+
+	if exists(t, store, "uploads/first.mp4") || exists(t, store, "uploads/second.mp4") {
+		t.Error("delete policy left a source behind")
+	}
+	if repo.sources[lessonId] != nil {
+		t.Errorf("lesson still retains %+v", repo.sources[lessonId])
+	}
+}
@@ -0,0 +1,18 @@
+package service
+
+import (
+	"errors"
+	"worker-transcode/dto"
+	"worker-transcode/pkg/storage"
+)
+
+// resolveTarget maps a message's storage target onto a configured profile. An
+// unknown profile never resolves on a retry, so it fails the job.
+func resolveTarget(stores *storage.Registry, target dto.StorageTarget) (storage.Target, error) {
+	resolved, err := stores.Resolve(target.Profile, target.Bucket)
+	if err != nil {
+		return storage.Target{}, errors.Join(ErrNonRetryable, err)
+	}
+
+	return resolved, nil
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+	"time"
+	"worker-transcode/config"
+	"worker-transcode/constant"
+	"worker-transcode/pkg/failure"
+	"worker-transcode/pkg/scratch"
+	"worker-transcode/repository"
+)
+
+// reserveScratch reserves disk for the downloaded source, unless it is
+// streamed, and for the output. Renditions are encoded one at a time and
+// their segments leave the disk once uploaded, so the output estimate does
+// not grow with the ladder.
+func (s service) reserveScratch(ctx context.Context, jobId uuid.UUID, source objectLocation) (func(), error) {
+	info, err := source.Store.Stat(ctx, source.Bucket, source.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	size := uint64(float64(info.Size) * s.cfg.WorkDir.OutputFactor)
+	if !s.streams(info.Size) {
+		size += uint64(info.Size)
+	}
+
+	zerolog.Ctx(ctx).Info().Uint64("bytes", size).Msg("reserving scratch space")
+
+	release, err := s.cfg.Scratch.Reserve(jobId.String(), size)
+	if errors.Is(err, scratch.ErrExceedsCapacity) {
+		return nil, failure.NewPermanent("scratch_capacity_exceeded", err)
+	}
+	if errors.Is(err, scratch.ErrInsufficientSpace) {
+		return nil, failure.NewResourceExhausted("insufficient_scratch_space", err)
+	}
+	return release, err
+}
+
+// SweepScratch removes scratch directories that belong to no running job.
+// Only directories named after a job id are considered, the work directory
+// may be shared with other files. Directories of jobs still marked as
+// processing are kept unless they have not been touched for
+// work_dir.stale_after.
+func SweepScratch(ctx context.Context, repo repository.JobRepository, cfg *config.Config) error {
+	return cfg.Scratch.Sweep(ctx, func(ctx context.Context, name string, modified time.Time) bool {
+		jobId, err := uuid.Parse(name)
+		if err != nil || jobId.String() != name {
+			return true
+		}
+
+		job, err := repo.FindJobById(ctx, jobId)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false
+		}
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("job_id", name).Msg("failed to look up job, keeping scratch dir")
+			return true
+		}
+
+		return job.Status == constant.JobStatusProcessing && time.Since(modified) < cfg.WorkDir.StaleAfter
+	})
+}
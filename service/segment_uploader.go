@@ -0,0 +1,153 @@
+package service
+
+import (
+	"context"
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"worker-transcode/config"
+	"worker-transcode/pkg/storage"
+)
+
+// segmentUploader publishes HLS segments while ffmpeg is still encoding.
+// ffmpeg runs with -hls_flags temp_file, so a segment only appears under its
+// final name once it has been closed and can be uploaded right away. Anything
+// left over, and the playlists, are published by finish.
+type segmentUploader struct {
+	store        storage.ObjectStore
+	bucket       string
+	localDir     string
+	remotePrefix string
+	metadata     map[string]string
+	cfg          config.Upload
+
+	watcher  *fsnotify.Watcher
+	done     chan struct{}
+	stopped  sync.Once
+	uploaded int
+}
+
+func isSegmentFile(name string) bool {
+	switch filepath.Ext(name) {
+	case ".ts", ".m4s":
+		return true
+	}
+
+	return false
+}
+
+func isPlaylistFile(name string) bool {
+	return filepath.Ext(name) == ".m3u8"
+}
+
+func startSegmentUploader(ctx context.Context, store storage.ObjectStore, bucket, localDir, remotePrefix string, metadata map[string]string, cfg config.Upload) (*segmentUploader, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(localDir); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	u := &segmentUploader{
+		store:        store,
+		bucket:       bucket,
+		localDir:     localDir,
+		remotePrefix: remotePrefix,
+		metadata:     metadata,
+		cfg:          cfg,
+		watcher:      watcher,
+		done:         make(chan struct{}),
+	}
+	go u.watch(ctx)
+
+	return u, nil
+}
+
+func (u *segmentUploader) watch(ctx context.Context) {
+	defer close(u.done)
+
+	for {
+		select {
+		case event, ok := <-u.watcher.Events:
+			if !ok {
+				return
+			}
+			if !event.Has(fsnotify.Create) || !isSegmentFile(event.Name) {
+				continue
+			}
+			if err := u.upload(ctx, event.Name); err != nil {
+				// The file stays on disk and is retried by finish.
+				zerolog.Ctx(ctx).Warn().Err(err).Str("segment", event.Name).Msg("failed to stream segment")
+			}
+		case err, ok := <-u.watcher.Errors:
+			if !ok {
+				return
+			}
+			zerolog.Ctx(ctx).Warn().Err(err).Str("dir", u.localDir).Msg("segment watcher error")
+		}
+	}
+}
+
+func (u *segmentUploader) upload(ctx context.Context, localPath string) error {
+	objectName := strings.ReplaceAll(filepath.Join(u.remotePrefix, filepath.Base(localPath)), "\\", "/")
+	if err := uploadFile(ctx, u.store, u.bucket, objectName, localPath, putOptionsFor(objectName, u.metadata, u.cfg), u.cfg); err != nil {
+		return err
+	}
+
+	u.uploaded++
+
+	return os.Remove(localPath)
+}
+
+// stop ends the watch without publishing anything else. It may be called
+// more than once.
+func (u *segmentUploader) stop() {
+	u.stopped.Do(func() {
+		u.watcher.Close()
+		<-u.done
+	})
+}
+
+// finish stops watching and uploads the remaining files, playlists last so a
+// player never sees a playlist that references a missing segment.
+func (u *segmentUploader) finish(ctx context.Context) error {
+	u.stop()
+
+	entries, err := os.ReadDir(u.localDir)
+	if err != nil {
+		return err
+	}
+
+	var playlists []string
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		localPath := filepath.Join(u.localDir, entry.Name())
+		if isPlaylistFile(entry.Name()) {
+			playlists = append(playlists, localPath)
+			continue
+		}
+		if err := u.upload(ctx, localPath); err != nil {
+			return err
+		}
+	}
+
+	for _, playlist := range playlists {
+		if err := u.upload(ctx, playlist); err != nil {
+			return err
+		}
+	}
+
+	zerolog.Ctx(ctx).Info().
+		Str("dir", u.localDir).
+		Int("uploaded", u.uploaded).
+		Msg("rendition published")
+
+	return nil
+}
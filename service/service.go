@@ -2,57 +2,104 @@ package service
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
-	"github.com/minio/minio-go/v7"
+	"github.com/google/uuid"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
 	"os"
+	"path"
 	"path/filepath"
-	"strings"
+	"sync"
+	"time"
 	"worker-transcode/config"
 	"worker-transcode/constant"
 	"worker-transcode/dto"
+	"worker-transcode/entities"
+	"worker-transcode/pkg/failure"
+	"worker-transcode/pkg/storage"
 	"worker-transcode/repository"
 )
 
 var ErrNonRetryable = errors.New("non-retryable error")
 
+const slidesCheckpointName = "slides"
+
 type Service interface {
 	Process(ctx context.Context, message dto.JobMessage) error
 }
 
+var errJobRunning = errors.New("job is already running in this worker")
+
 type service struct {
 	repo repository.JobRepository
 	cfg  *config.Config
+	// running holds the ids of the jobs this worker processes, a message
+	// redelivered after a lost channel must not start a second run.
+	running *sync.Map
 }
 
 func (s service) Process(ctx context.Context, message dto.JobMessage) (err error) {
 	zerolog.Ctx(ctx).Info().Str("job_id", message.JobId.String()).Msg("processing job")
 	path := filepath.Dir(message.ObjectPath)
 	fileName := filepath.Base(message.ObjectPath)
+	outputPrefix := outputPrefixFor(path, message.JobId)
 	job, err := s.repo.FindJobById(ctx, message.JobId)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("job does not exist")
+		return failure.NewPermanent("job_not_found", err)
+	}
 	if err != nil {
 		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to find job by id")
 		return err
 	}
 
-	if job.Status != constant.JobStatusPending {
+	if job.Status != constant.JobStatusPending && !s.takeOver(job, message) {
 		zerolog.Ctx(ctx).Info().Str("job_id", message.JobId.String()).Msg("job is not pending")
 		return nil
 	}
+	if _, running := s.running.LoadOrStore(job.ID, struct{}{}); running {
+		return failure.NewWaiting("job_running", errJobRunning)
+	}
+	defer s.running.Delete(job.ID)
+	if job.Status == constant.JobStatusProcessing {
+		zerolog.Ctx(ctx).Warn().
+			Bool("redelivered", message.Redelivered).
+			Time("updated_at", job.UpdatedAt).
+			Msg("taking over job whose worker went away")
+	}
 
-	if err := s.repo.UpdateStatusJob(ctx, constant.JobStatusProcessing, message.JobId); err != nil {
+	events := newJobEvents(s.repo, s.cfg.Events, job)
+	if err := events.transition(ctx, constant.JobStatusProcessing, events.started); err != nil {
 		log.Error().Err(err).Msg("failed to update job status")
 		return err
 	}
 
+	var destination storage.Target
+	// Non-retryable errors fail the job and are swallowed. Final errors, the
+	// ones the message is dead-lettered for, fail it too and are returned.
 	defer func() {
+		err = failOnIntegrity(ctx, err)
 		if err != nil {
-			if errors.Is(err, ErrNonRetryable) {
-				if updateErr := s.repo.UpdateStatusJob(ctx, constant.JobStatusFailed, message.JobId); updateErr != nil {
+			if errors.Is(err, ErrNonRetryable) || failure.Final(ctx, err) {
+				cause := err
+				if updateErr := events.transition(ctx, constant.JobStatusFailed, func(ctx context.Context) error {
+					return events.failed(ctx, cause)
+				}); updateErr != nil {
 					log.Error().Err(updateErr).Msg("failed to update job status")
 				}
-				err = nil
+				if deleteErr := s.repo.DeleteJobCheckpoints(ctx, message.JobId); deleteErr != nil {
+					log.Error().Err(deleteErr).Msg("failed to delete job checkpoints")
+				}
+				if destination.Store != nil {
+					if removeErr := removePrefix(ctx, destination.Store, destination.Bucket, outputPrefix); removeErr != nil {
+						log.Error().Err(removeErr).Str("prefix", outputPrefix).Msg("failed to remove output of failed job")
+					}
+				}
+				if errors.Is(err, ErrNonRetryable) {
+					err = nil
+				}
 			} else {
 				if updateErr := s.repo.UpdateStatusJob(ctx, constant.JobStatusPending, message.JobId); updateErr != nil {
 					log.Error().Err(updateErr).Msg("failed to update job status")
@@ -61,7 +108,18 @@ func (s service) Process(ctx context.Context, message dto.JobMessage) (err error
 		}
 	}()
 
-	tempDir := filepath.Join("temp", message.JobId.String())
+	sourceTarget, err := resolveTarget(s.cfg.Stores, message.Source)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to resolve source storage")
+		return err
+	}
+	destination, err = resolveTarget(s.cfg.Stores, message.Destination)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to resolve destination storage")
+		return err
+	}
+
+	tempDir := s.cfg.Scratch.JobDir(message.JobId.String())
 	defer os.RemoveAll(tempDir)
 
 	inputDir := filepath.Join(tempDir, "input")
@@ -76,81 +134,422 @@ func (s service) Process(ctx context.Context, message dto.JobMessage) (err error
 		return errors.Join(ErrNonRetryable, err)
 	}
 
-	inputFilepath := filepath.Join(inputDir, fileName)
-	zerolog.Ctx(ctx).Info().Str("input_file", inputFilepath).Msg("downloading input file")
-	err = s.cfg.Storage.FGetObject(ctx, s.cfg.MinIOBucket, message.ObjectPath, inputFilepath, minio.GetObjectOptions{})
+	checkpoints, err := s.repo.GetJobCheckpoints(ctx, message.JobId)
 	if err != nil {
-		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to download file")
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to get job checkpoints")
 		return err
 	}
 
-	zerolog.Ctx(ctx).Info().Msg("transcode file")
-	if err = transcodeToHLS(inputFilepath, outputDir); err != nil {
-		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to transcode file")
+	done := make(map[string]bool, len(checkpoints))
+	var (
+		sourceHash string
+		info       *MediaInfo
+	)
+	for _, checkpoint := range checkpoints {
+		done[checkpoint.Rendition] = true
+		sourceHash = checkpoint.SourceHash
+		if info == nil && checkpoint.MediaInfo != "" {
+			info = &MediaInfo{}
+			if jsonErr := json.Unmarshal([]byte(checkpoint.MediaInfo), info); jsonErr != nil {
+				info = nil
+			}
+		}
+	}
+	if len(checkpoints) > 0 {
+		zerolog.Ctx(ctx).Info().Int("checkpoints", len(checkpoints)).Msg("resuming job from checkpoints")
+	}
+
+	needsSource := info == nil || (message.ExtractSlides && !done[slidesCheckpointName])
+	if info != nil {
+		for _, rend := range planRenditions(info, s.cfg.Transcode) {
+			if !done[rend.Name] {
+				needsSource = true
+			}
+		}
+	}
+
+	metadata := map[string]string{
+		"job-id":    message.JobId.String(),
+		"lesson-id": job.EntityId.String(),
+	}
+
+	profile := ladderProfile(s.cfg.Transcode)
+	inputFilepath := filepath.Join(inputDir, fileName)
+	source := objectLocation{Target: sourceTarget, Key: message.ObjectPath}
+	var (
+		input sourceInput
+		// streamHash waits for the hash of a streamed source, which is only
+		// known once the source was read in full.
+		streamHash func() (string, error)
+	)
+	if needsSource {
+		var linked *entities.JobResult
+		linked, err = s.claimSource(ctx, job, sourceTarget, message.ObjectPath)
+		if failure.KindOf(err) == failure.Waiting {
+			zerolog.Ctx(ctx).Info().Err(err).Msg("upload is being encoded by another job, waiting for it")
+			return err
+		}
+		if err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Msg("failed to claim source file")
+			return err
+		}
+		if linked != nil {
+			zerolog.Ctx(ctx).Info().Str("prefix", linked.ObjectPrefix).Msg("upload was already encoded by another job, linking its output")
+			if err = s.linkResult(ctx, events, message.JobId, linked); err != nil {
+				zerolog.Ctx(ctx).Error().Err(err).Msg("failed to link output of another job")
+			}
+			return err
+		}
+
+		source, err = s.resolveSource(ctx, job, sourceTarget, message.ObjectPath)
+		if err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Msg("failed to resolve source file")
+			return err
+		}
+
+		var release func()
+		release, err = s.reserveScratch(ctx, message.JobId, source)
+		if err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Msg("failed to reserve scratch space")
+			return err
+		}
+		defer release()
+
+		input, sourceHash, err = s.openSource(ctx, source, inputFilepath)
+		if err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Msg("failed to open input file")
+			return err
+		}
+		if input.Remote && sourceHash == "" {
+			hashCtx, cancelHash := context.WithCancel(ctx)
+			defer cancelHash()
+			streamHash = hashSource(hashCtx, source, input.Object)
+		}
+	}
+
+	if len(checkpoints) == 0 && sourceHash != "" {
+		existing, err := s.repo.FindSourceHash(ctx, sourceHash, profile)
+		if err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Msg("failed to look up source hash")
+			return err
+		}
+		if existing != nil && (existing.HasSlides || !message.ExtractSlides) {
+			zerolog.Ctx(ctx).Info().
+				Str("source_hash", sourceHash).
+				Str("existing_prefix", existing.OutputPrefix).
+				Msg("identical source already transcoded, reusing output")
+			existingTarget, copyErr := resolveTarget(s.cfg.Stores, dto.StorageTarget{Profile: existing.Profile, Bucket: existing.Bucket})
+			if copyErr == nil && (existing.OutputPrefix != outputPrefix || existingTarget != destination) {
+				copyErr = copyPrefix(ctx, existingTarget, existing.OutputPrefix, destination, outputPrefix)
+			}
+			if copyErr == nil {
+				if err = s.complete(ctx, events, message, job, destination, outputPrefix, source, tempDir, metadata); err != nil {
+					return err
+				}
+				// The copy becomes the output the hash points at, the one it
+				// was copied from may belong to the version just replaced.
+				s.saveSourceHash(ctx, sourceHash, profile, destination, outputPrefix, existing.HasSlides, message.JobId)
+				return nil
+			}
+			zerolog.Ctx(ctx).Warn().Err(copyErr).Msg("failed to reuse existing output, transcoding from scratch")
+		}
+	}
+
+	if info == nil {
+		zerolog.Ctx(ctx).Info().Msg("probe file")
+		info, err = probe(ctx, input)
+		if err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Msg("failed to probe file")
+			return errors.Join(ErrNonRetryable, err)
+		}
+	}
+
+	mediaInfo, err := json.Marshal(info)
+	if err != nil {
 		return errors.Join(ErrNonRetryable, err)
 	}
+	saveCheckpoint := func(name string) error {
+		err := s.repo.SaveJobCheckpoint(ctx, &entities.JobCheckpoint{
+			JobId:        message.JobId,
+			Rendition:    name,
+			ObjectPrefix: outputPrefix,
+			SourceHash:   sourceHash,
+			MediaInfo:    string(mediaInfo),
+		})
+		if err == nil {
+			if touchErr := s.repo.TouchJob(ctx, message.JobId); touchErr != nil {
+				zerolog.Ctx(ctx).Warn().Err(touchErr).Msg("failed to touch job")
+			}
+		}
+		return err
+	}
 
-	if err = createMasterPlaylist(outputDir); err != nil {
+	if input.Location != "" && !done[posterCheckpointName] {
+		zerolog.Ctx(ctx).Info().Msg("extract poster")
+		posterPath := filepath.Join(tempDir, posterFileName)
+		posterErr := extractPoster(input, info, posterPath)
+		if posterErr == nil {
+			posterKey := outputPrefix + "/" + posterFileName
+			posterErr = uploadFile(ctx, destination.Store, destination.Bucket, posterKey, posterPath, putOptionsFor(posterKey, metadata, s.cfg.Upload), s.cfg.Upload)
+		}
+		if posterErr == nil {
+			posterErr = saveCheckpoint(posterCheckpointName)
+		}
+		if posterErr != nil {
+			zerolog.Ctx(ctx).Warn().Err(posterErr).Msg("failed to extract poster, continuing without it")
+		}
+	}
+
+	renditions := planRenditions(info, s.cfg.Transcode)
+	encoded := 0
+	var pending []rendition
+	for _, rend := range renditions {
+		if done[rend.Name] {
+			encoded++
+			zerolog.Ctx(ctx).Info().Str("rendition", rend.Name).Msg("rendition already checkpointed, skipping")
+			continue
+		}
+		pending = append(pending, rend)
+	}
+
+	// Every ffmpeg run reads a streamed source over the network again, so its
+	// renditions are encoded in one run. A downloaded source is encoded one
+	// rendition at a time, a retry then only repeats the one that failed.
+	batches := [][]rendition{pending}
+	if !input.Remote {
+		batches = make([][]rendition, 0, len(pending))
+		for _, rend := range pending {
+			batches = append(batches, []rendition{rend})
+		}
+	}
+	for _, batch := range batches {
+		if len(batch) == 0 {
+			continue
+		}
+
+		uploaders := make([]*segmentUploader, 0, len(batch))
+		stopUploaders := func() {
+			for _, uploader := range uploaders {
+				uploader.stop()
+			}
+		}
+		for _, rend := range batch {
+			if err = removeRenditionObjects(ctx, destination.Store, destination.Bucket, outputPrefix, rend.Name); err != nil {
+				stopUploaders()
+				zerolog.Ctx(ctx).Error().Err(err).Str("rendition", rend.Name).Msg("failed to clean up previous attempt")
+				return err
+			}
+
+			renditionDir := filepath.Join(outputDir, rend.Name)
+			if err = os.MkdirAll(renditionDir, os.ModePerm); err != nil {
+				stopUploaders()
+				zerolog.Ctx(ctx).Error().Err(err).Msg("failed to create rendition dir")
+				return errors.Join(ErrNonRetryable, err)
+			}
+
+			uploader, err := startSegmentUploader(ctx, destination.Store, destination.Bucket, renditionDir, outputPrefix, metadata, s.cfg.Upload)
+			if err != nil {
+				stopUploaders()
+				zerolog.Ctx(ctx).Error().Err(err).Msg("failed to watch rendition dir")
+				return err
+			}
+			uploaders = append(uploaders, uploader)
+		}
+
+		zerolog.Ctx(ctx).Info().Str("renditions", renditionNames(batch)).Msg("transcode renditions")
+		if err = transcodeRenditions(input, outputDir, info, s.cfg.Transcode, batch); err != nil {
+			stopUploaders()
+			zerolog.Ctx(ctx).Error().Err(err).Msg("failed to transcode file")
+			return errors.Join(ErrNonRetryable, err)
+		}
+
+		for i, rend := range batch {
+			zerolog.Ctx(ctx).Info().Str("rendition", rend.Name).Msg("publish rendition")
+			if err = uploaders[i].finish(ctx); err != nil {
+				stopUploaders()
+				zerolog.Ctx(ctx).Error().Err(err).Msg("failed to upload rendition")
+				return err
+			}
+			os.RemoveAll(filepath.Join(outputDir, rend.Name))
+
+			if err = saveCheckpoint(rend.Name); err != nil {
+				stopUploaders()
+				zerolog.Ctx(ctx).Error().Err(err).Msg("failed to save checkpoint")
+				return err
+			}
+			encoded++
+			events.progress(ctx, rend.Name, encoded, len(renditions))
+		}
+	}
+
+	hasSlides := done[slidesCheckpointName]
+	if message.ExtractSlides && !hasSlides {
+		zerolog.Ctx(ctx).Info().Msg("extract slides")
+		slidesDir := filepath.Join(tempDir, "slides")
+		_, slideErr := extractSlides(ctx, input, tempDir, slidesDir, s.cfg.Slides.SceneThreshold, s.cfg.Slides.MaxHashDistance)
+		if slideErr == nil {
+			slideErr = uploadDirectory(ctx, destination.Store, destination.Bucket, slidesDir, filepath.Join(outputPrefix, "slides"), metadata, s.cfg.Upload)
+		}
+		if slideErr == nil {
+			hasSlides = true
+			slideErr = saveCheckpoint(slidesCheckpointName)
+		}
+		if slideErr != nil {
+			zerolog.Ctx(ctx).Warn().Err(slideErr).Msg("failed to extract slides, continuing without them")
+		}
+	}
+
+	if err = createMasterPlaylist(outputDir, info, s.cfg.Transcode); err != nil {
 		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to create master playlist")
 		return errors.Join(ErrNonRetryable, err)
 	}
 
-	zerolog.Ctx(ctx).Info().Msg("upload transcode file")
-	err = uploadDirectory(ctx, s.cfg.Storage, s.cfg.MinIOBucket, outputDir, path)
+	zerolog.Ctx(ctx).Info().Msg("upload master playlist")
+	err = uploadDirectory(ctx, destination.Store, destination.Bucket, outputDir, outputPrefix, metadata, s.cfg.Upload)
 	if err != nil {
 		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to upload directory")
 		return err
 	}
 
-	zerolog.Ctx(ctx).Info().Msg("deleting original file")
-	err = s.cfg.Storage.RemoveObject(ctx, s.cfg.MinIOBucket, message.ObjectPath, minio.RemoveObjectOptions{})
-	if err != nil {
-		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to delete original file")
+	if err = writeManifest(ctx, destination.Store, destination.Bucket, outputPrefix, tempDir, metadata, s.cfg.Upload); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to write checksum manifest")
 		return err
 	}
 
-	if err = s.repo.UpdateStatusJob(ctx, constant.JobStatusCompleted, message.JobId); err != nil {
-		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to update job status")
-		return err
+	if input.Remote {
+		if err = verifyStreamed(ctx, source, input); err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Msg("streamed source failed verification")
+			return err
+		}
+	}
+	// The hash is awaited before completing, which applies the retention
+	// policy and may move or delete the source while it is still read.
+	if streamHash != nil {
+		hash, hashErr := streamHash()
+		switch {
+		case errors.Is(hashErr, ErrIntegrity):
+			zerolog.Ctx(ctx).Error().Err(hashErr).Msg("streamed source failed verification")
+			return hashErr
+		case hashErr != nil:
+			zerolog.Ctx(ctx).Warn().Err(hashErr).Msg("failed to hash streamed source, completing without it")
+		default:
+			sourceHash = hash
+		}
 	}
 
-	if err = s.repo.UpdateLessonVideoURL(ctx, job.EntityId, filepath.Join(path, "master.m3u8")); err != nil {
-		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to update lesson video url")
+	if err = s.complete(ctx, events, message, job, destination, outputPrefix, source, tempDir, metadata); err != nil {
 		return err
 	}
 
-	zerolog.Ctx(ctx).Info().Str("job_id", message.JobId.String()).Msg("job completed")
+	if sourceHash != "" {
+		s.saveSourceHash(ctx, sourceHash, profile, destination, outputPrefix, hasSlides, message.JobId)
+	}
 
 	return nil
 }
 
-func uploadDirectory(ctx context.Context, client *minio.Client, bucket, localPath, remotePrefix string) error {
-	return filepath.Walk(localPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+// takeOver reports whether a job still marked as processing is run again.
+// Its worker went away when the broker redelivers the message or when the job
+// was not touched for work_dir.stale_after, the new run resumes from the
+// checkpoints of the old one.
+func (s service) takeOver(job *entities.Job, message dto.JobMessage) bool {
+	if job.Status != constant.JobStatusProcessing {
+		return false
+	}
+
+	return message.Redelivered || time.Since(job.UpdatedAt) >= s.cfg.WorkDir.StaleAfter
+}
 
-		if info.IsDir() {
-			return nil
+// saveSourceHash records the output of a completed job for later jobs with an
+// identical source. The job is complete either way, so failures only log.
+func (s service) saveSourceHash(ctx context.Context, hash, profile string, destination storage.Target, outputPrefix string, hasSlides bool, jobId uuid.UUID) {
+	if err := s.repo.SaveSourceHash(ctx, &entities.SourceHash{
+		Hash:          hash,
+		LadderProfile: profile,
+		Profile:       destination.Profile,
+		Bucket:        destination.Bucket,
+		OutputPrefix:  outputPrefix,
+		HasSlides:     hasSlides,
+		JobId:         jobId,
+	}); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("failed to save source hash")
+	}
+}
+
+// complete verifies the HLS output below outputPrefix and, in one
+// transaction, switches the lesson over to the output, records the job result
+// and completes the job. Once that committed it applies the retention policy
+// to the source and removes the output of the version the lesson played
+// before.
+func (s service) complete(ctx context.Context, events *jobEvents, message dto.JobMessage, job *entities.Job, destination storage.Target, outputPrefix string, source objectLocation, tempDir string, metadata map[string]string) error {
+	if err := verifyHLSOutput(ctx, destination.Store, destination.Bucket, outputPrefix); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("output verification failed, discarding attempt")
+		if deleteErr := s.repo.DeleteJobCheckpoints(ctx, message.JobId); deleteErr != nil {
+			zerolog.Ctx(ctx).Error().Err(deleteErr).Msg("failed to delete job checkpoints")
 		}
+		if removeErr := removePrefix(ctx, destination.Store, destination.Bucket, outputPrefix); removeErr != nil {
+			zerolog.Ctx(ctx).Error().Err(removeErr).Msg("failed to remove unverified output")
+		}
+		return err
+	}
 
-		relativePath, err := filepath.Rel(localPath, path)
-		if err != nil {
+	result, err := s.hlsResult(ctx, message.JobId, destination, outputPrefix, tempDir, metadata)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to build job result")
+		return err
+	}
+
+	previous, err := s.previousOutput(ctx, job.EntityId, outputPrefix)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to find previous output of lesson")
+		return err
+	}
+
+	masterKey := path.Join(outputPrefix, "master.m3u8")
+	err = s.repo.Transaction(ctx, func(ctx context.Context) error {
+		if err := s.repo.UpdateLessonVideoURL(ctx, job.EntityId, masterKey); err != nil {
+			return err
+		}
+		if err := s.repo.SaveJobResult(ctx, result); err != nil {
+			return err
+		}
+		if err := s.repo.UpdateStatusJob(ctx, constant.JobStatusCompleted, message.JobId); err != nil {
 			return err
 		}
+		return events.completed(ctx, jobOutput(result, masterKey))
+	})
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to complete job")
+		return err
+	}
 
-		objectName := filepath.Join(remotePrefix, relativePath)
+	if err = s.repo.DeleteJobCheckpoints(ctx, message.JobId); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("failed to delete job checkpoints")
+	}
 
-		objectName = strings.ReplaceAll(objectName, "\\", "/")
+	// Retention moves or deletes the source, which a retry of the
+	// transaction above could not read any more, so it only runs once the job
+	// is complete. A source it failed on is left where it is.
+	if err = s.retainSource(ctx, job, source); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("policy", s.cfg.Retention.Policy).Msg("failed to apply source retention policy")
+	}
 
-		_, uploadErr := client.FPutObject(ctx, bucket, objectName, path, minio.PutObjectOptions{})
-		return uploadErr
-	})
+	if previous != nil {
+		zerolog.Ctx(ctx).Info().Str("prefix", previous.ObjectPrefix).Msg("removing previous output of lesson")
+		if err = s.removeOutput(ctx, previous); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("prefix", previous.ObjectPrefix).Msg("failed to remove previous output of lesson")
+		}
+	}
+
+	zerolog.Ctx(ctx).Info().Str("job_id", message.JobId.String()).Msg("job completed")
+
+	return nil
 }
 
 func NewService(repo repository.JobRepository, cfg *config.Config) Service {
 	return &service{
-		repo: repo,
-		cfg:  cfg,
+		repo:    repo,
+		cfg:     cfg,
+		running: &sync.Map{},
 	}
 }
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"testing"
+	"time"
+	"worker-transcode/config"
+	"worker-transcode/constant"
+	"worker-transcode/dto"
+	"worker-transcode/entities"
+)
+
+func TestTakeOver(t *testing.T) {
+	s := service{cfg: &config.Config{WorkDir: config.WorkDir{StaleAfter: time.Hour}}}
+	tests := []struct {
+		name        string
+		status      constant.JobStatus
+		updated     time.Duration
+		redelivered bool
+		takeOver    bool
+	}{
+		{"pending", constant.JobStatusPending, 0, true, false},
+		{"processing", constant.JobStatusProcessing, time.Minute, false, false},
+		{"processing redelivered", constant.JobStatusProcessing, time.Minute, true, true},
+		{"processing stale", constant.JobStatusProcessing, 2 * time.Hour, false, true},
+		{"completed redelivered", constant.JobStatusCompleted, 2 * time.Hour, true, false},
+		{"failed", constant.JobStatusFailed, 2 * time.Hour, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := &entities.Job{Status: tt.status, UpdatedAt: time.Now().Add(-tt.updated)}
+			if got := s.takeOver(job, dto.JobMessage{Redelivered: tt.redelivered}); got != tt.takeOver {
+				t.Errorf("takeOver() = %v, want %v", got, tt.takeOver)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog"
+	"image"
+	_ "image/jpeg"
+	"math/bits"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+const slideIndexFileName = "slides.json"
+
+type Slide struct {
+	Index     int     `json:"index"`
+	Timestamp float64 `json:"timestamp"`
+	Image     string  `json:"image"`
+}
+
+type SlideIndex struct {
+	Slides []Slide `json:"slides"`
+}
+
+var showinfoPtsTime = regexp.MustCompile(`\[Parsed_showinfo.*\] n:\s*\d+ .*pts_time:([0-9.]+)`)
+
+// extractSlides grabs the first frame plus every scene change from the input,
+// drops candidates that look like a slide we already kept and writes the
+// remaining images together with slides.json into slidesDir.
+func extractSlides(ctx context.Context, input sourceInput, workDir, slidesDir string, sceneThreshold float64, maxHashDistance int) ([]Slide, error) {
+	candidatesDir := filepath.Join(workDir, "slide_candidates")
+	if err := os.MkdirAll(candidatesDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(candidatesDir)
+
+	if err := os.MkdirAll(slidesDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	ffmpegArgs := append(input.args(),
+		"-an",
+		"-vf", fmt.Sprintf("select='eq(n\\,0)+gt(scene\\,%g)',showinfo,scale='min(1280,iw)':-2", sceneThreshold),
+		"-vsync", "vfr",
+		"-q:v", "2",
+		"-y",
+		filepath.Join(candidatesDir, "candidate_%05d.jpg"),
+	)
+
+	zerolog.Ctx(ctx).Info().Strs("ffmpeg_args", input.redactArgs(ffmpegArgs)).Msg("extracting slide candidates")
+
+	cmd := exec.Command("ffmpeg", ffmpegArgs...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg slide extraction failed: %w\nOutput: %s", err, string(output))
+	}
+
+	var timestamps []float64
+	for _, match := range showinfoPtsTime.FindAllStringSubmatch(string(output), -1) {
+		ts, parseErr := strconv.ParseFloat(match[1], 64)
+		if parseErr != nil {
+			continue
+		}
+		timestamps = append(timestamps, ts)
+	}
+
+	candidates, err := filepath.Glob(filepath.Join(candidatesDir, "candidate_*.jpg"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(candidates)
+
+	var (
+		slides []Slide
+		hashes []uint64
+	)
+	for i, candidate := range candidates {
+		hash, err := perceptualHashFile(candidate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash slide candidate %s: %w", candidate, err)
+		}
+
+		duplicate := false
+		for _, kept := range hashes {
+			if bits.OnesCount64(hash^kept) <= maxHashDistance {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			continue
+		}
+
+		timestamp := 0.0
+		if i < len(timestamps) {
+			timestamp = timestamps[i]
+		}
+
+		imageName := fmt.Sprintf("slide_%03d.jpg", len(slides)+1)
+		if err := os.Rename(candidate, filepath.Join(slidesDir, imageName)); err != nil {
+			return nil, err
+		}
+
+		hashes = append(hashes, hash)
+		slides = append(slides, Slide{
+			Index:     len(slides) + 1,
+			Timestamp: timestamp,
+			Image:     imageName,
+		})
+	}
+
+	content, err := json.MarshalIndent(SlideIndex{Slides: slides}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(slidesDir, slideIndexFileName), content, 0644); err != nil {
+		return nil, err
+	}
+
+	zerolog.Ctx(ctx).Info().
+		Int("candidates", len(candidates)).
+		Int("slides", len(slides)).
+		Msg("slides extracted")
+
+	return slides, nil
+}
+
+func perceptualHashFile(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return 0, err
+	}
+
+	return differenceHash(img), nil
+}
+
+// differenceHash computes a 64-bit dHash: the image is shrunk to a 9x8
+// grayscale grid and each bit records whether a cell is brighter than its
+// right-hand neighbour.
+func differenceHash(img image.Image) uint64 {
+	const width, height = 9, 8
+
+	bounds := img.Bounds()
+	var grid [height][width]float64
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+
+			var sum float64
+			var count int
+			for py := y0; py < y1; py++ {
+				for px := x0; px < x1; px++ {
+					r, g, b, _ := img.At(px, py).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+					count++
+				}
+			}
+			if count > 0 {
+				grid[y][x] = sum / float64(count)
+			}
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < height; y++ {
+		for x := 0; x < width-1; x++ {
+			hash <<= 1
+			if grid[y][x] > grid[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+
+	return hash
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"image"
+	"image/color"
+	"math/bits"
+	"testing"
+)
+
+// gradient draws an image whose brightness falls from left to right, or rises
+// when reversed.
+func gradient(width, height int, reversed bool) image.Image {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			value := 255 - x*255/width
+			if reversed {
+				value = 255 - value
+			}
+			img.SetGray(x, y, color.Gray{Y: uint8(value)})
+		}
+	}
+	return img
+}
+
+func uniform(width, height int, value uint8) image.Image {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetGray(x, y, color.Gray{Y: value})
+		}
+	}
+	return img
+}
+
+func TestDifferenceHash(t *testing.T) {
+	tests := []struct {
+		name string
+		img  image.Image
+		hash uint64
+	}{
+		{"falling brightness", gradient(180, 80, false), ^uint64(0)},
+		{"rising brightness", gradient(180, 80, true), 0},
+		{"uniform", uniform(64, 64, 128), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := differenceHash(tt.img); got != tt.hash {
+				t.Errorf("differenceHash() = %016x, want %016x", got, tt.hash)
+			}
+		})
+	}
+}
+
+func TestDifferenceHashIgnoresScale(t *testing.T) {
+	small := differenceHash(gradient(90, 40, false))
+	large := differenceHash(gradient(1920, 1080, false))
+	if distance := bits.OnesCount64(small ^ large); distance > 2 {
+		t.Errorf("hash distance between scales = %d", distance)
+	}
+}
@@ -7,44 +7,179 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"worker-transcode/config"
 )
 
 type Resolution struct {
 	Width     int
 	Height    int
-	Bitrate   string // e.g., "800k"
-	AudioRate string // e.g., "96k"
+	Bitrate   string  // e.g., "800k"
+	AudioRate string  // e.g., "96k"
+	FrameRate float64 // target constant frame rate
 }
 
 // Define the target resolutions for HLS.
 var resolutions = []Resolution{
-	{Width: 256, Height: 144, Bitrate: "200k", AudioRate: "64k"},
-	{Width: 640, Height: 360, Bitrate: "800k", AudioRate: "96k"},
-	{Width: 854, Height: 480, Bitrate: "1500k", AudioRate: "128k"},
-	{Width: 1280, Height: 720, Bitrate: "3000k", AudioRate: "192k"},
-	{Width: 1920, Height: 1080, Bitrate: "5000k", AudioRate: "192k"},
+	{Width: 256, Height: 144, Bitrate: "200k", AudioRate: "64k", FrameRate: 30},
+	{Width: 640, Height: 360, Bitrate: "800k", AudioRate: "96k", FrameRate: 30},
+	{Width: 854, Height: 480, Bitrate: "1500k", AudioRate: "128k", FrameRate: 30},
+	{Width: 1280, Height: 720, Bitrate: "3000k", AudioRate: "192k", FrameRate: 30},
+	{Width: 1920, Height: 1080, Bitrate: "5000k", AudioRate: "192k", FrameRate: 30},
 }
 
-func transcodeToHLS(inputFilepath, outputDir string) error {
-	var filterComplexBuilder strings.Builder
+// hdrResolution is the extra 10-bit HEVC rendition offered to HDR sources
+// when transcode.hdr_variant is enabled.
+var hdrResolution = Resolution{Width: 1920, Height: 1080, Bitrate: "8000k", AudioRate: "192k", FrameRate: 30}
+
+const hdrPlaylistName = "hdr_1080p.m3u8"
+
+// sdrColorFilters converts HDR and wide-gamut sources to BT.709 SDR and makes
+// sure libx264 always receives 8-bit 4:2:0 input.
+func sdrColorFilters(info *MediaInfo) []string {
+	if info.HDR {
+		return []string{
+			"zscale=t=linear:npl=100",
+			"format=gbrpf32le",
+			"zscale=p=bt709",
+			"tonemap=tonemap=hable:desat=0",
+			"zscale=t=bt709:m=bt709:r=tv",
+			"format=yuv420p",
+		}
+	}
+	if info.ColorPrimaries == "bt2020" {
+		return []string{"zscale=p=bt709:t=bt709:m=bt709:r=tv", "format=yuv420p"}
+	}
+
+	return []string{"format=yuv420p"}
+}
+
+func withHDRVariant(info *MediaInfo, opts config.Transcode) bool {
+	return info.HDR && opts.HDRVariant
+}
+
+const audioRenditionName = "audio"
+
+// rendition is one independently checkpointed HLS playlist, a retried job
+// skips the ones that are already stored.
+type rendition struct {
+	Name       string
+	Resolution Resolution
+	HDR        bool
+	Audio      bool
+}
+
+func planRenditions(info *MediaInfo, opts config.Transcode) []rendition {
+	var plan []rendition
+	if info.HasAudio {
+		plan = append(plan, rendition{Name: audioRenditionName, Audio: true})
+	}
 	for _, r := range resolutions {
-		filterComplexBuilder.WriteString(
-			fmt.Sprintf("[0:v]scale=w=%d:h=%d:force_original_aspect_ratio=decrease,pad=w=%d:h=%d:x=(ow-iw)/2:y=(oh-ih)/2[v%d]; ",
-				r.Width, r.Height, r.Width, r.Height, r.Height))
+		plan = append(plan, rendition{Name: fmt.Sprintf("%dp", r.Height), Resolution: r})
+	}
+	if withHDRVariant(info, opts) {
+		plan = append(plan, rendition{Name: strings.TrimSuffix(hdrPlaylistName, ".m3u8"), Resolution: hdrResolution, HDR: true})
 	}
 
-	ffmpegArgs := []string{
-		"-i", inputFilepath,
-		"-filter_complex", strings.TrimSuffix(filterComplexBuilder.String(), "; "),
+	return plan
+}
+
+// buildFilterGraph normalises the source (rotation, deinterlacing and, for
+// SDR renditions, tone mapping) and scales it to a constant frame rate for
+// the given resolution. The video it produces is labelled label.
+func buildFilterGraph(info *MediaInfo, opts config.Transcode, r Resolution, hdr bool, label string) string {
+	var filters []string
+	switch info.Rotation {
+	case 90:
+		filters = append(filters, "transpose=clock")
+	case 180:
+		filters = append(filters, "hflip", "vflip")
+	case 270:
+		filters = append(filters, "transpose=cclock")
 	}
 
-	for _, r := range resolutions {
+	if info.Interlaced {
+		switch opts.Deinterlacer {
+		case "yadif":
+			filters = append(filters, "yadif=mode=send_frame:parity=auto:deint=interlaced")
+		default:
+			filters = append(filters, "bwdif=mode=send_frame:parity=auto:deint=interlaced")
+		}
+	}
 
-		playlistName := fmt.Sprintf("%dp.m3u8", r.Height)
-		segmentName := fmt.Sprintf("%dp_%%03d.ts", r.Height)
+	if hdr {
+		filters = append(filters, scaleFilter(info, r), "format=yuv420p10le")
+	} else {
+		filters = append(filters, sdrColorFilters(info)...)
+		filters = append(filters, scaleFilter(info, r))
+	}
+
+	return "[0:v]" + strings.Join(filters, ",") + "[" + label + "]"
+}
+
+func scaleFilter(info *MediaInfo, r Resolution) string {
+	var filter string
+	if r.FrameRate > 0 && (info.VariableFrameRate || info.FrameRate > r.FrameRate) {
+		filter = fmt.Sprintf("fps=fps=%g,", r.FrameRate)
+	}
+
+	return filter + fmt.Sprintf("scale=w=%d:h=%d:force_original_aspect_ratio=decrease,pad=w=%d:h=%d:x=(ow-iw)/2:y=(oh-ih)/2",
+		r.Width, r.Height, r.Width, r.Height)
+}
+
+// renditionOutput returns the filter chain and the output options of rend,
+// which is written to outputDir. Its video is labelled label, the audio
+// rendition has no filter chain.
+func renditionOutput(info *MediaInfo, opts config.Transcode, rend rendition, outputDir, label string) (string, []string) {
+	switch {
+	case rend.Audio:
+		highestAudioRate := "96k" // Default
+		if len(resolutions) > 0 {
+			highestAudioRate = resolutions[len(resolutions)-1].AudioRate
+		}
+		return "", []string{
+			"-map", "0:a:0?",
+			"-c:a", "aac",
+			"-b:a", highestAudioRate,
+			"-f", "hls",
+			"-hls_time", "6",
+			"-hls_playlist_type", "vod",
+			"-hls_flags", "temp_file",
+			"-hls_segment_filename", filepath.Join(outputDir, "audio_%03d.ts"),
+			filepath.Join(outputDir, "audio.m3u8"),
+		}
+	case rend.HDR:
+		r := rend.Resolution
+		return buildFilterGraph(info, opts, r, true, label), []string{
+			"-map", "[" + label + "]",
+
+			"-c:v", "libx265",
+			"-preset", "fast",
+			"-tag:v", "hvc1",
+			"-pix_fmt", "yuv420p10le",
+			"-b:v", r.Bitrate,
+			"-maxrate", r.Bitrate,
+			"-bufsize", r.Bitrate,
+			"-color_primaries", "bt2020",
+			"-color_trc", info.ColorTransfer,
+			"-colorspace", "bt2020nc",
+			"-x265-params", fmt.Sprintf("colorprim=bt2020:transfer=%s:colormatrix=bt2020nc:repeat-headers=1", info.ColorTransfer),
+			// fMP4 keeps the display matrix of the source, the picture is
+			// already rotated by the filter graph.
+			"-metadata:s:v:0", "rotate=0",
 
-		ffmpegArgs = append(ffmpegArgs,
-			"-map", fmt.Sprintf("[v%d]", r.Height),
+			"-f", "hls",
+			"-hls_time", "6",
+			"-hls_playlist_type", "vod",
+			"-hls_flags", "temp_file",
+			"-hls_segment_type", "fmp4",
+			"-hls_fmp4_init_filename", rend.Name + "_init.mp4",
+			"-hls_segment_filename", filepath.Join(outputDir, rend.Name+"_%03d.m4s"),
+			filepath.Join(outputDir, rend.Name+".m3u8"),
+		}
+	default:
+		r := rend.Resolution
+		return buildFilterGraph(info, opts, r, false, label), []string{
+			"-map", "[" + label + "]",
 
 			"-c:v", "libx264",
 			"-preset", "veryfast",
@@ -52,64 +187,120 @@ func transcodeToHLS(inputFilepath, outputDir string) error {
 			"-b:v", r.Bitrate,
 			"-maxrate", r.Bitrate,
 			"-bufsize", r.Bitrate,
+			"-pix_fmt", "yuv420p",
+			"-color_primaries", "bt709",
+			"-color_trc", "bt709",
+			"-colorspace", "bt709",
 
 			"-f", "hls",
 			"-hls_time", "6",
 			"-hls_playlist_type", "vod",
-			"-hls_segment_filename", filepath.Join(outputDir, segmentName),
-			filepath.Join(outputDir, playlistName),
-		)
+			"-hls_flags", "temp_file",
+			"-hls_segment_filename", filepath.Join(outputDir, rend.Name+"_%03d.ts"),
+			filepath.Join(outputDir, rend.Name+".m3u8"),
+		}
 	}
+}
+
+// transcodeRenditionsArgs builds one ffmpeg run that reads the input once and
+// writes every rendition into its own directory below outputDir.
+func transcodeRenditionsArgs(input sourceInput, outputDir string, info *MediaInfo, opts config.Transcode, rends []rendition) []string {
+	// Rotation is applied explicitly in the filter graph.
+	ffmpegArgs := append([]string{"-noautorotate"}, input.args()...)
 
-	highestAudioRate := "96k" // Default
-	if len(resolutions) > 0 {
-		highestAudioRate = resolutions[len(resolutions)-1].AudioRate
+	var (
+		filters []string
+		outputs []string
+	)
+	for i, rend := range rends {
+		filter, output := renditionOutput(info, opts, rend, filepath.Join(outputDir, rend.Name), fmt.Sprintf("v%d", i))
+		if filter != "" {
+			filters = append(filters, filter)
+		}
+		outputs = append(outputs, output...)
+	}
+	if len(filters) > 0 {
+		ffmpegArgs = append(ffmpegArgs, "-filter_complex", strings.Join(filters, ";"))
 	}
-	ffmpegArgs = append(ffmpegArgs,
-		"-map", "0:a:0?",
-		"-c:a", "aac",
-		"-b:a", highestAudioRate,
-		"-f", "hls",
-		"-hls_time", "6",
-		"-hls_playlist_type", "vod",
-		"-hls_segment_filename", filepath.Join(outputDir, "audio_%03d.ts"),
-		filepath.Join(outputDir, "audio.m3u8"))
+
+	return append(ffmpegArgs, outputs...)
+}
+
+// transcodeRenditions encodes rends in a single ffmpeg run, each into the
+// directory below outputDir named after it.
+func transcodeRenditions(input sourceInput, outputDir string, info *MediaInfo, opts config.Transcode, rends []rendition) error {
+	ffmpegArgs := transcodeRenditionsArgs(input, outputDir, info, opts, rends)
 
 	cmd := exec.Command("ffmpeg", ffmpegArgs...)
-	log.Printf("Executing FFmpeg command: ffmpeg %s", strings.Join(ffmpegArgs, " "))
+	log.Printf("Executing FFmpeg command: ffmpeg %s", strings.Join(input.redactArgs(ffmpegArgs), " "))
 
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		log.Printf("FFmpeg output:\n%s\n", string(output))
-		return fmt.Errorf("ffmpeg execution failed: %w", err)
+		return fmt.Errorf("ffmpeg execution failed for %s: %w", renditionNames(rends), err)
 	}
 
 	return nil
 }
 
-func createMasterPlaylist(outputDir string) error {
+func renditionNames(rends []rendition) string {
+	names := make([]string, 0, len(rends))
+	for _, rend := range rends {
+		names = append(names, rend.Name)
+	}
+
+	return strings.Join(names, ", ")
+}
+
+func createMasterPlaylist(outputDir string, info *MediaInfo, opts config.Transcode) error {
 	masterPlaylistPath := filepath.Join(outputDir, "master.m3u8")
 	var contentBuilder strings.Builder
+	hdr := withHDRVariant(info, opts)
+	// fMP4 segments of the HDR variant need version 7.
+	version := 3
+	if hdr {
+		version = 7
+	}
 	contentBuilder.WriteString("#EXTM3U\n")
-	contentBuilder.WriteString("#EXT-X-VERSION:3\n\n")
+	contentBuilder.WriteString(fmt.Sprintf("#EXT-X-VERSION:%d\n\n", version))
 
-	contentBuilder.WriteString(`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="English",DEFAULT=YES,AUTOSELECT=YES,URI="audio.m3u8"` + "\n\n")
+	audioCodec, audioGroup := "", ""
+	if info.HasAudio {
+		contentBuilder.WriteString(`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="English",DEFAULT=YES,AUTOSELECT=YES,URI="audio.m3u8"` + "\n\n")
+		audioCodec, audioGroup = ",mp4a.40.2", `,AUDIO="audio"`
+	}
 
 	log.Println("Creating master playlist...")
 
 	for _, r := range resolutions {
-		var videoBitrateBPS int
-		fmt.Sscanf(r.Bitrate, "%dk", &videoBitrateBPS)
-
-		var audioBitrateBPS int
-		fmt.Sscanf(r.AudioRate, "%dk", &audioBitrateBPS)
-
-		totalBandwidth := (videoBitrateBPS + audioBitrateBPS) * 1000
-
 		playlistName := fmt.Sprintf("%dp.m3u8", r.Height)
-		contentBuilder.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,CODECS=\"avc1.640028,mp4a.40.2\",AUDIO=\"audio\"\n", totalBandwidth, r.Width, r.Height))
+		streamInf := fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,CODECS=\"avc1.640028%s\"%s", totalBandwidth(r), r.Width, r.Height, audioCodec, audioGroup)
+		if hdr {
+			streamInf += ",VIDEO-RANGE=SDR"
+		}
+		contentBuilder.WriteString(streamInf + "\n")
 		contentBuilder.WriteString(playlistName + "\n")
 	}
 
+	if hdr {
+		videoRange := "PQ"
+		if info.ColorTransfer == "arib-std-b67" {
+			videoRange = "HLG"
+		}
+		contentBuilder.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,CODECS=\"hvc1.2.4.L123.B0%s\"%s,VIDEO-RANGE=%s\n",
+			totalBandwidth(hdrResolution), hdrResolution.Width, hdrResolution.Height, audioCodec, audioGroup, videoRange))
+		contentBuilder.WriteString(hdrPlaylistName + "\n")
+	}
+
 	return os.WriteFile(masterPlaylistPath, []byte(contentBuilder.String()), 0644)
 }
+
+func totalBandwidth(r Resolution) int {
+	var videoBitrateBPS int
+	fmt.Sscanf(r.Bitrate, "%dk", &videoBitrateBPS)
+
+	var audioBitrateBPS int
+	fmt.Sscanf(r.AudioRate, "%dk", &audioBitrateBPS)
+
+	return (videoBitrateBPS + audioBitrateBPS) * 1000
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"worker-transcode/config"
+)
+
+func TestTranscodeRenditionsArgs(t *testing.T) {
+	info := &MediaInfo{HasAudio: true, FrameRate: 30}
+	plan := planRenditions(info, config.Transcode{})
+	input := sourceInput{Location: "https://minio/video.mp4", Remote: true}
+
+	args := transcodeRenditionsArgs(input, "out", info, config.Transcode{}, plan)
+
+	if n := strings.Count(strings.Join(args, " "), " -i "); n != 1 {
+		t.Errorf("args read the input %d times", n)
+	}
+	filter := args[slices.Index(args, "-filter_complex")+1]
+	if chains := strings.Split(filter, ";"); len(chains) != len(plan)-1 {
+		t.Errorf("filter_complex has %d chains, want one per video rendition", len(chains))
+	}
+	for i, rend := range plan {
+		playlist := "out/" + rend.Name + "/" + rend.Name + ".m3u8"
+		if !slices.Contains(args, playlist) {
+			t.Errorf("args do not write %s", playlist)
+		}
+		if !rend.Audio && !slices.Contains(args, "[v"+string(rune('0'+i))+"]") {
+			t.Errorf("args do not map the video of %s", rend.Name)
+		}
+	}
+}
+
+func TestTranscodeRenditionsArgsAudioOnly(t *testing.T) {
+	info := &MediaInfo{HasAudio: true}
+	args := transcodeRenditionsArgs(localInput("in.mp4"), "out", info, config.Transcode{}, planRenditions(info, config.Transcode{})[:1])
+
+	if slices.Contains(args, "-filter_complex") {
+		t.Errorf("args = %q, want no filter graph for the audio rendition", args)
+	}
+}
+
+func TestRenditionOutputClearsRotation(t *testing.T) {
+	info := &MediaInfo{HDR: true, Rotation: 90, ColorTransfer: "smpte2084"}
+	opts := config.Transcode{HDRVariant: true}
+	plan := planRenditions(info, opts)
+
+	filter, args := renditionOutput(info, opts, plan[len(plan)-1], "out", "v0")
+	if !strings.Contains(filter, "transpose=clock") {
+		t.Errorf("filter = %q, want the source rotated", filter)
+	}
+	if i := slices.Index(args, "-metadata:s:v:0"); i < 0 || args[i+1] != "rotate=0" {
+		t.Errorf("args = %q, want the display matrix cleared", args)
+	}
+}
+
+func TestCreateMasterPlaylistVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		info *MediaInfo
+		opts config.Transcode
+		want string
+	}{
+		{"sdr", &MediaInfo{HasAudio: true}, config.Transcode{HDRVariant: true}, "#EXT-X-VERSION:3\n"},
+		{"hdr without variant", &MediaInfo{HDR: true}, config.Transcode{}, "#EXT-X-VERSION:3\n"},
+		{"hdr variant", &MediaInfo{HDR: true, ColorTransfer: "smpte2084"}, config.Transcode{HDRVariant: true}, "#EXT-X-VERSION:7\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := createMasterPlaylist(dir, tt.info, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			content, err := os.ReadFile(filepath.Join(dir, "master.m3u8"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(content), tt.want) {
+				t.Errorf("master playlist = %q, want %q", content, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/cenkalti/backoff/v5"
+	"github.com/rs/zerolog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"worker-transcode/config"
+	"worker-transcode/pkg/storage"
+)
+
+var contentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".mpd":  "application/dash+xml",
+	".ts":   "video/mp2t",
+	".m4s":  "video/iso.segment",
+	".mp4":  "video/mp4",
+	".vtt":  "text/vtt",
+	".jpg":  "image/jpeg",
+	".json": "application/json",
+}
+
+// putOptionsFor picks the Content-Type and Cache-Control for an emitted
+// artifact. Segments never change once written, manifests might.
+func putOptionsFor(objectName string, metadata map[string]string, cfg config.Upload) storage.PutOptions {
+	ext := strings.ToLower(filepath.Ext(objectName))
+	contentType, ok := contentTypes[ext]
+	if !ok {
+		contentType = "application/octet-stream"
+	}
+
+	cacheControl := cfg.CacheControl.Default
+	switch {
+	case ext == ".ts" || ext == ".m4s" || strings.HasSuffix(objectName, "_init.mp4"):
+		cacheControl = cfg.CacheControl.Segments
+	case ext == ".m3u8" || ext == ".mpd" || ext == ".json":
+		cacheControl = cfg.CacheControl.Manifests
+	}
+
+	return storage.PutOptions{
+		ContentType:  contentType,
+		CacheControl: cacheControl,
+		UserMetadata: metadata,
+	}
+}
+
+type UploadFailure struct {
+	Object string
+	Err    error
+}
+
+// UploadError lists every object that still failed after all retries.
+type UploadError struct {
+	Failures []UploadFailure
+}
+
+func (e *UploadError) Error() string {
+	objects := make([]string, 0, len(e.Failures))
+	for _, failure := range e.Failures {
+		objects = append(objects, fmt.Sprintf("%s (%v)", failure.Object, failure.Err))
+	}
+
+	return fmt.Sprintf("%d object(s) failed to upload: %s", len(e.Failures), strings.Join(objects, "; "))
+}
+
+func (e *UploadError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failures))
+	for _, failure := range e.Failures {
+		errs = append(errs, failure.Err)
+	}
+
+	return errs
+}
+
+// uploadFile uploads a single file with its SHA-256 as object metadata and
+// checks the stored object afterwards, retrying with exponential backoff.
+func uploadFile(ctx context.Context, store storage.ObjectStore, bucket, objectName, localPath string, opts storage.PutOptions, cfg config.Upload) error {
+	sum, size, err := fileSHA256(localPath)
+	if err != nil {
+		return err
+	}
+
+	metadata := make(map[string]string, len(opts.UserMetadata)+1)
+	for k, v := range opts.UserMetadata {
+		metadata[k] = v
+	}
+	metadata[checksumMetadataKey] = sum
+	opts.UserMetadata = metadata
+	opts.PartSize = cfg.PartSize
+	opts.PartThreads = cfg.PartThreads
+
+	operation := func() (struct{}, error) {
+		err := storage.FPut(ctx, store, bucket, objectName, localPath, opts)
+		if err == nil {
+			err = verifyUploaded(ctx, store, bucket, objectName, size, sum)
+		}
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("object", objectName).Msg("upload attempt failed")
+		}
+		return struct{}{}, err
+	}
+
+	bo := backoff.NewExponentialBackOff()
+	if cfg.InitialBackoff > 0 {
+		bo.InitialInterval = cfg.InitialBackoff
+	}
+	if cfg.MaxBackoff > 0 {
+		bo.MaxInterval = cfg.MaxBackoff
+	}
+
+	maxAttempts := uint(1)
+	if cfg.MaxAttempts > 1 {
+		maxAttempts = uint(cfg.MaxAttempts)
+	}
+
+	_, err = backoff.Retry(ctx, operation, backoff.WithBackOff(bo), backoff.WithMaxTries(maxAttempts))
+	return err
+}
+
+// uploadDirectory uploads every file below localPath with a bounded pool of
+// workers. All files are attempted, failures are reported together.
+func uploadDirectory(ctx context.Context, store storage.ObjectStore, bucket, localPath, remotePrefix string, metadata map[string]string, cfg config.Upload) error {
+	type uploadTask struct {
+		localPath  string
+		objectName string
+	}
+
+	var tasks []uploadTask
+	err := filepath.Walk(localPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(localPath, path)
+		if err != nil {
+			return err
+		}
+
+		objectName := filepath.Join(remotePrefix, relativePath)
+
+		objectName = strings.ReplaceAll(objectName, "\\", "/")
+
+		tasks = append(tasks, uploadTask{localPath: path, objectName: objectName})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	numWorkers := cfg.Concurrency
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		failures []UploadFailure
+	)
+	queue := make(chan uploadTask)
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range queue {
+				opts := putOptionsFor(task.objectName, metadata, cfg)
+				if err := uploadFile(ctx, store, bucket, task.objectName, task.localPath, opts, cfg); err != nil {
+					mu.Lock()
+					failures = append(failures, UploadFailure{Object: task.objectName, Err: err})
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, task := range tasks {
+		queue <- task
+	}
+	close(queue)
+	wg.Wait()
+
+	if len(failures) > 0 {
+		sort.Slice(failures, func(i, j int) bool {
+			return failures[i].Object < failures[j].Object
+		})
+		return &UploadError{Failures: failures}
+	}
+
+	return nil
+}
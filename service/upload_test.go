@@ -0,0 +1,159 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"worker-transcode/config"
+	"worker-transcode/pkg/storage"
+)
+
+// flakyStore fails every Put of the keys in failing and counts the attempts.
+type flakyStore struct {
+	storage.ObjectStore
+	mu       sync.Mutex
+	failing  map[string]bool
+	attempts map[string]int
+}
+
+var errPutFailed = errors.New("put failed")
+
+func (s *flakyStore) Put(ctx context.Context, bucket, key string, reader io.Reader, size int64, opts storage.PutOptions) error {
+	s.mu.Lock()
+	s.attempts[key]++
+	failing := s.failing[key]
+	s.mu.Unlock()
+
+	if failing {
+		return errPutFailed
+	}
+	return s.ObjectStore.Put(ctx, bucket, key, reader, size, opts)
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUploadDirectory(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"master.m3u8":      "#EXTM3U",
+		"720p/index.m3u8":  "#EXTM3U",
+		"720p/segment0.ts": "segment",
+	})
+	store := storage.NewMemory()
+	cfg := config.Upload{Concurrency: 2, MaxAttempts: 1}
+
+	if err := uploadDirectory(ctx, store, "content", dir, "lessons/1/hls", map[string]string{"job-id": "1"}, cfg); err != nil {
+		t.Fatalf("uploadDirectory() = %v", err)
+	}
+
+	objects, err := store.List(ctx, "content", "lessons/1/hls/")
+	if err != nil {
+		t.Fatalf("List() = %v", err)
+	}
+	var keys []string
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	if got := strings.Join(keys, ","); got != "lessons/1/hls/720p/index.m3u8,lessons/1/hls/720p/segment0.ts,lessons/1/hls/master.m3u8" {
+		t.Errorf("uploaded = %s", got)
+	}
+
+	info, err := store.Stat(ctx, "content", "lessons/1/hls/720p/segment0.ts")
+	if err != nil {
+		t.Fatalf("Stat() = %v", err)
+	}
+	sum, _, err := fileSHA256(filepath.Join(dir, "720p", "segment0.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.UserMetadata[checksumMetadataKey] != sum || info.UserMetadata["job-id"] != "1" {
+		t.Errorf("metadata = %v", info.UserMetadata)
+	}
+}
+
+func TestUploadDirectoryReportsEveryFailure(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.ts":        "a",
+		"b.ts":        "b",
+		"master.m3u8": "#EXTM3U",
+	})
+	store := &flakyStore{
+		ObjectStore: storage.NewMemory(),
+		failing:     map[string]bool{"hls/a.ts": true, "hls/b.ts": true},
+		attempts:    make(map[string]int),
+	}
+	cfg := config.Upload{Concurrency: 3, MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	err := uploadDirectory(context.Background(), store, "content", dir, "hls", nil, cfg)
+
+	var uploadErr *UploadError
+	if !errors.As(err, &uploadErr) {
+		t.Fatalf("uploadDirectory() = %v, want an UploadError", err)
+	}
+	if len(uploadErr.Failures) != 2 || uploadErr.Failures[0].Object != "hls/a.ts" || uploadErr.Failures[1].Object != "hls/b.ts" {
+		t.Errorf("failures = %+v", uploadErr.Failures)
+	}
+	if !errors.Is(err, errPutFailed) {
+		t.Errorf("uploadDirectory() = %v, want it to wrap %v", err, errPutFailed)
+	}
+	if store.attempts["hls/a.ts"] != 3 || store.attempts["hls/master.m3u8"] != 1 {
+		t.Errorf("attempts = %v", store.attempts)
+	}
+	if _, err := store.Stat(context.Background(), "content", "hls/master.m3u8"); err != nil {
+		t.Errorf("Stat() of the healthy object = %v", err)
+	}
+}
+
+func TestPutOptionsFor(t *testing.T) {
+	cfg := config.Upload{CacheControl: config.CacheControl{
+		Segments:  "immutable",
+		Manifests: "short",
+		Default:   "default",
+	}}
+	tests := []struct {
+		object       string
+		contentType  string
+		cacheControl string
+	}{
+		{"hls/720p_000.ts", "video/mp2t", "immutable"},
+		{"hls/720p_000.m4s", "video/iso.segment", "immutable"},
+		{"hls/720p_init.mp4", "video/mp4", "immutable"},
+		{"hls/master.m3u8", "application/vnd.apple.mpegurl", "short"},
+		{"hls/MASTER.M3U8", "application/vnd.apple.mpegurl", "short"},
+		{"hls/manifest.json", "application/json", "short"},
+		{"hls/poster.jpg", "image/jpeg", "default"},
+		{"recordings/final.mp4", "video/mp4", "default"},
+		{"hls/unknown.bin", "application/octet-stream", "default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.object, func(t *testing.T) {
+			opts := putOptionsFor(tt.object, map[string]string{"job-id": "1"}, cfg)
+			if opts.ContentType != tt.contentType || opts.CacheControl != tt.cacheControl {
+				t.Errorf("putOptionsFor() = %q, %q, want %q, %q", opts.ContentType, opts.CacheControl, tt.contentType, tt.cacheControl)
+			}
+			if opts.UserMetadata["job-id"] != "1" {
+				t.Errorf("metadata = %v", opts.UserMetadata)
+			}
+		})
+	}
+}